@@ -0,0 +1,164 @@
+/* Render a d4 program to a WAV file:
+
+    d4 [flags] program.d4
+
+or try out d4 code interactively:
+
+    d4 repl [flags]
+*/
+package main
+
+import (
+    "bufio"
+    "flag"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+
+    "github.com/drawk-cab/d4"
+)
+
+/* Frames rendered per call to FillInterleaved32 */
+const CHUNK = 4096
+
+/* Look for packages as files in dir, trying the name as given and in lower
+   case, with and without a .d4 extension (d4 words are always upper case) */
+
+func dir_imports(dir string) func(string) (string, error) {
+    return func(name string) (string, error) {
+        for _, file := range []string{ name, name + ".d4", strings.ToLower(name), strings.ToLower(name) + ".d4" } {
+            code, err := os.ReadFile(filepath.Join(dir, file))
+            if err == nil {
+                return string(code), nil
+            }
+        }
+        return "", fmt.Errorf("no package %s in %s", name, dir)
+    }
+}
+
+func load_midi(machine d4.Machine, file string) error {
+    in, err := os.Open(file)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+    return machine.LoadMIDI(bufio.NewReader(in))
+}
+
+func render(program string, out string, seconds float64, config d4.Config, channels int, bits int, midi string) (err error) {
+
+    in, err := os.Open(program)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+
+    machine, err := d4.NewMachine(in, config)
+    if err != nil {
+        return err
+    }
+
+    if midi != "" {
+        err = load_midi(machine, midi)
+        if err != nil {
+            return err
+        }
+    }
+
+    f, err := os.Create(out)
+    if err != nil {
+        return err
+    }
+    defer func() {
+        f.Close()
+        if err != nil {
+            // don't leave half a WAV file lying around
+            os.Remove(out)
+        }
+    }()
+
+    w := bufio.NewWriter(f)
+
+    sample_rate := int(config.SampleRate)
+    frames := int(seconds * config.SampleRate)
+    err = write_wav_header(w, sample_rate, channels, bits, frames)
+    if err != nil {
+        return err
+    }
+
+    buf := make([]float32, CHUNK * channels)
+    for done := 0; done < frames; done += CHUNK {
+        if frames - done < CHUNK {
+            buf = buf[:(frames - done) * channels]
+        }
+
+        err = machine.FillInterleaved32(buf, channels)
+        if err != nil {
+            return err
+        }
+
+        err = write_wav_samples(w, buf, bits)
+        if err != nil {
+            return err
+        }
+    }
+
+    return w.Flush()
+}
+
+func main() {
+    if len(os.Args) > 1 && os.Args[1] == "repl" {
+        repl(os.Args[2:])
+        return
+    }
+
+    out := flag.String("o", "", "WAV file to write (default: the program name with .wav)")
+    seconds := flag.Float64("d", 10, "duration in seconds")
+    sample_rate := flag.Int("rate", 44100, "sample rate in Hz")
+    clip := flag.Float64("clip", 1, "scale output down by this factor (the program can override with CLIP)")
+    channels := flag.Int("channels", 1, "number of channels to render, at least 1")
+    bits := flag.Int("bits", 16, "16 for integer samples, 32 for float")
+    workers := flag.Int("workers", 1, "number of samples to render in parallel")
+    save_s := flag.Float64("save", 1, "seconds of KEEP history to store for OLD")
+    imports := flag.String("imports", "", "directory to import packages from (default: the program's directory)")
+    tempo := flag.Float64("tempo", d4.DEFAULT_TEMPO, "beats per minute, for BEAT")
+    seed := flag.Int64("seed", 1, "random seed for NOISE")
+    midi := flag.String("midi", "", "MIDI file for NOTE, VELOCITY, GATE and AGE to play")
+
+    flag.Usage = func() {
+        fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] program.d4\n       %s repl [flags]\n", os.Args[0], os.Args[0])
+        flag.PrintDefaults()
+    }
+    flag.Parse()
+
+    if flag.NArg() != 1 || (*bits != 16 && *bits != 32) || *channels < 1 {
+        flag.Usage()
+        os.Exit(2)
+    }
+
+    program := flag.Arg(0)
+
+    if *out == "" {
+        *out = strings.TrimSuffix(program, filepath.Ext(program)) + ".wav"
+    }
+
+    if *imports == "" {
+        *imports = filepath.Dir(program)
+    }
+
+    config := d4.DefaultConfig()
+    config.SampleRate = float64(*sample_rate)
+    config.SaveSeconds = *save_s
+    config.Clip = *clip
+    config.Imports = dir_imports(*imports)
+    config.Workers = *workers
+    config.Tempo = *tempo
+    config.Seed = *seed
+
+    err := render(program, *out, *seconds, config, *channels, *bits, *midi)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+}
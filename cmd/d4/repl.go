@@ -0,0 +1,160 @@
+package main
+
+import (
+    "bufio"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "strconv"
+    "strings"
+
+    "github.com/drawk-cab/d4"
+)
+
+const REPL_HELP = `Type d4 code to run it once and see the stack and output.
+Definitions are remembered for later lines.
+
+  \t SECONDS   run at this time (T follows)
+  \i ITER      run at this iteration
+  \set NAME N  set a control (\set TEMPO N sets the tempo)
+  \words       list defined words
+  \midi FILE   play a MIDI file with NOTE, VELOCITY, GATE and AGE
+  \debug       trace every opcode (toggle)
+  \q           quit
+`
+
+func format_values(values []float64) string {
+    parts := make([]string, len(values))
+    for i, v := range values {
+        parts[i] = strconv.FormatFloat(v, 'g', -1, 64)
+    }
+    return strings.Join(parts, " ")
+}
+
+func format_output(output []d4.Output) string {
+    parts := make([]string, len(output))
+    for i, o := range output {
+        parts[i] = strconv.FormatFloat(o.Value, 'g', -1, 64)
+        if o.Channel != d4.ALL_CHANNELS {
+            parts[i] += fmt.Sprintf("@%d", o.Channel)
+        }
+    }
+    return strings.Join(parts, " ")
+}
+
+/* Handle a \ command, returning false to quit */
+
+func repl_command(out io.Writer, m *d4.OpcodeMachine, line string, sample_rate float64, iter *int64) bool {
+    fields := strings.Fields(line)
+
+    switch {
+        case fields[0] == "\\q":
+            return false
+
+        case fields[0] == "\\t" && len(fields) == 2:
+            seconds, err := strconv.ParseFloat(fields[1], 64)
+            if err != nil {
+                fmt.Fprintln(out, err)
+                break
+            }
+            if !(seconds >= 0) {
+                fmt.Fprintln(out, "time can't be negative")
+                break
+            }
+            *iter = int64(seconds * sample_rate)
+
+        case fields[0] == "\\i" && len(fields) == 2:
+            i, err := strconv.ParseInt(fields[1], 10, 64)
+            if err != nil {
+                fmt.Fprintln(out, err)
+                break
+            }
+            if i < 0 {
+                fmt.Fprintln(out, "iteration can't be negative")
+                break
+            }
+            *iter = i
+
+        case fields[0] == "\\set" && len(fields) == 3:
+            value, err := strconv.ParseFloat(fields[2], 64)
+            if err == nil {
+                err = m.Set(fields[1], value)
+            }
+            if err != nil {
+                fmt.Fprintln(out, err)
+            }
+
+        case fields[0] == "\\midi" && len(fields) == 2:
+            err := load_midi(m, fields[1])
+            if err != nil {
+                fmt.Fprintln(out, err)
+            }
+
+        case fields[0] == "\\words":
+            fmt.Fprintln(out, strings.Join(m.Words(), " "))
+
+        case fields[0] == "\\debug":
+            debug := !m.GetData().Config().Debug
+            m.SetDebug(debug)
+            fmt.Fprintln(out, "debug", debug)
+
+        default:
+            fmt.Fprint(out, REPL_HELP)
+    }
+    return true
+}
+
+func run_repl(in io.Reader, out io.Writer, m *d4.OpcodeMachine, sample_rate float64) {
+    var iter int64 = 1
+
+    fmt.Fprintln(out, `d4 repl, \h for help`)
+
+    scanner := bufio.NewScanner(in)
+    for {
+        fmt.Fprintf(out, "[%d %.4gs] ", iter, float64(iter) / sample_rate)
+        if !scanner.Scan() {
+            fmt.Fprintln(out)
+            return
+        }
+
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" {
+            continue
+        }
+
+        if strings.HasPrefix(line, "\\") {
+            if !repl_command(out, m, line, sample_rate, &iter) {
+                return
+            }
+            continue
+        }
+
+        output, stack, err := m.Eval(strings.NewReader(line), iter)
+        if err != nil {
+            fmt.Fprintln(out, err)
+        }
+        fmt.Fprintln(out, "stack:", format_values(stack))
+        fmt.Fprintln(out, "out:  ", format_output(output))
+    }
+}
+
+func repl(args []string) {
+    flags := flag.NewFlagSet("repl", flag.ExitOnError)
+    sample_rate := flags.Float64("rate", 44100, "sample rate in Hz")
+    save_s := flags.Float64("save", 1, "seconds of KEEP history to store for OLD")
+    imports := flags.String("imports", ".", "directory to import packages from")
+    smooth := flags.Float64("smooth", 0, "seconds for controls to glide to values from \\set")
+    flags.Parse(args)
+
+    config := d4.DefaultConfig()
+    config.SampleRate = *sample_rate
+    config.SaveSeconds = *save_s
+    config.Imports = dir_imports(*imports)
+    config.Smoothing = *smooth
+
+    m := d4.NewOpcodeMachine(config)
+    m.Init(nil)
+
+    run_repl(os.Stdin, os.Stdout, m, *sample_rate)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+    "encoding/binary"
+    "io"
+    "math"
+)
+
+const WAV_PCM = 1
+const WAV_FLOAT = 3
+
+/* Write the RIFF header for a WAV file of `frames` frames. bits is 16 for
+   integer PCM or 32 for float */
+
+func write_wav_header(w io.Writer, sample_rate int, channels int, bits int, frames int) error {
+    format := WAV_PCM
+    if bits == 32 {
+        format = WAV_FLOAT
+    }
+
+    block_align := channels * bits / 8
+    data_len := frames * block_align
+
+    // float files need the extended fmt chunk and a fact chunk
+    fmt_len := 16
+    header_len := 4 + (8 + fmt_len) + (8 + data_len)
+    if format == WAV_FLOAT {
+        fmt_len = 18
+        header_len = 4 + (8 + fmt_len) + (8 + 4) + (8 + data_len)
+    }
+
+    fields := []interface{}{
+        []byte("RIFF"), uint32(header_len), []byte("WAVE"),
+        []byte("fmt "), uint32(fmt_len),
+        uint16(format), uint16(channels), uint32(sample_rate),
+        uint32(sample_rate * block_align), uint16(block_align), uint16(bits),
+    }
+
+    if format == WAV_FLOAT {
+        fields = append(fields, uint16(0), []byte("fact"), uint32(4), uint32(frames))
+    }
+
+    fields = append(fields, []byte("data"), uint32(data_len))
+
+    for _, f := range fields {
+        err := binary.Write(w, binary.LittleEndian, f)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func write_wav_samples(w io.Writer, buf []float32, bits int) error {
+    if bits == 32 {
+        return binary.Write(w, binary.LittleEndian, buf)
+    }
+
+    samples := make([]int16, len(buf))
+    for i, s := range buf {
+        s = float32(math.Max(-1, math.Min(1, float64(s))))
+        samples[i] = int16(math.Round(float64(s) * math.MaxInt16))
+    }
+    return binary.Write(w, binary.LittleEndian, samples)
+}
@@ -0,0 +1,81 @@
+package d4
+
+import (
+    "log"
+    "os"
+)
+
+/* loop length in seconds, will get a click after this, default to 1 day(!) */
+const LOOP = 60 * 60 * 24
+
+/* Beats per minute a machine starts with, until it's Set to something else */
+const DEFAULT_TEMPO = 120
+
+/* Everything about a machine that isn't in its program. Start from DefaultConfig
+   and change what you need, so two machines in one process can differ */
+type Config struct {
+    SampleRate float64
+    SaveSeconds float64  // how much KEEP history to store for OLD
+    Clip float64         // the program can change this with CLIP
+    Imports func(string) (string, error) // the code for each :: package
+    Workers int          // how many samples to work out at once
+    Loop float64         // seconds before T goes back to 0
+    Tuning Tuning        // for note names and SHARP and FLAT, unless the program says TUNING
+    Tempo float64        // beats per minute, until Set("TEMPO", bpm)
+    Debug bool           // trace every opcode to Logger
+    Logger *log.Logger
+    Seed int64           // for NOISE, so renders can be repeated
+    Polyphony int        // most voices playing at once on each track, before the oldest is cut off
+    MaxDelay float64     // seconds, the longest any DELAY, ECHO, COMB or ALLPASS can look back
+    Smoothing float64    // seconds (time constant) for controls to move to a new value from Set, or 0 for at once
+}
+
+func DefaultConfig() Config {
+    return Config{
+        SampleRate: 44100,
+        SaveSeconds: 1,
+        Clip: 1,
+        Workers: 1,
+        Loop: LOOP,
+        Tuning: EqualTemperament(12),
+        Tempo: DEFAULT_TEMPO,
+        Logger: log.New(os.Stdout, "", 0),
+        Seed: 1,
+        Polyphony: 8,
+        MaxDelay: 1,
+    }
+}
+
+/* Fill in anything left at zero which the machine can't run without */
+
+func (c Config) with_defaults() Config {
+    d := DefaultConfig()
+    if c.SampleRate <= 0 {
+        c.SampleRate = d.SampleRate
+    }
+    if c.Clip <= 0 {
+        c.Clip = d.Clip
+    }
+    if c.Loop <= 0 {
+        c.Loop = d.Loop
+    }
+    if c.Tuning == nil {
+        c.Tuning = d.Tuning
+    }
+    if c.Tempo <= 0 {
+        c.Tempo = d.Tempo
+    }
+    if c.Workers < 1 {
+        c.Workers = d.Workers
+    }
+    if c.Polyphony < 1 {
+        c.Polyphony = d.Polyphony
+    }
+    if c.MaxDelay <= 0 {
+        c.MaxDelay = d.MaxDelay
+    }
+    if c.Logger == nil {
+        c.Logger = d.Logger
+    }
+    return c
+}
@@ -0,0 +1,83 @@
+package d4
+
+import (
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+)
+
+/* What a program says about one of its controls, so a player can show a slider for it.
+   A control starts at its default unless it has already been Set. Controls declared
+   without { default min max unit } have no default (it's NaN), go from -Inf to +Inf,
+   and aren't set until they're Set */
+type ControlInfo struct {
+    Name string
+    Default float64
+    Min float64
+    Max float64
+    Unit string
+}
+
+/* The control described by the words between { and }: default, min, max and an optional unit */
+
+func parse_control_info( name string, spec []string ) (ControlInfo, error) {
+    info := ControlInfo{name, 0, math.Inf(-1), math.Inf(1), ""}
+
+    if len(spec) < 3 || len(spec) > 4 {
+        return info, fmt.Errorf("expected { default min max unit } for %s", name)
+    }
+
+    values := make([]float64, 3)
+    for i := range values {
+        v, err := strconv.ParseFloat(spec[i], 64)
+        if err != nil {
+            return info, fmt.Errorf("expected a number in { default min max unit } for %s, not %s", name, spec[i])
+        }
+        values[i] = v
+    }
+    info.Default, info.Min, info.Max = values[0], values[1], values[2]
+    if len(spec) == 4 {
+        info.Unit = spec[3]
+    }
+
+    if info.Min > info.Max || info.Default < info.Min || info.Default > info.Max {
+        return info, fmt.Errorf("default %v for %s isn't from %v to %v", info.Default, name, info.Min, info.Max)
+    }
+    return info, nil
+}
+
+/* A CONSTANT which the program stores to with ! isn't a control, as storing it
+   as well as Setting it would set it twice */
+
+func (m *OpcodeMachine) drop_stored_controls() {
+    for _, defn := range m.words {
+        for i := 1; i < len(defn); i++ {
+            name := strings.ToUpper(defn[i-1].word)
+            _, control := m.control_keys[name]
+            if defn[i].word == "!" && control {
+                delete(m.control_keys, name)
+                delete(m.control_info, name)
+            }
+        }
+    }
+
+    order := []string{}
+    for _, name := range m.control_order {
+        _, ok := m.control_info[name]
+        if ok {
+            order = append(order, name)
+        }
+    }
+    m.control_order = order
+}
+
+/* The controls of the program, in the order they were declared */
+
+func (m *OpcodeMachine) Controls() []ControlInfo {
+    controls := make([]ControlInfo, len(m.control_order))
+    for i, name := range m.control_order {
+        controls[i] = m.control_info[name]
+    }
+    return controls
+}
@@ -6,9 +6,30 @@ import (
     "fmt"
     "os"
     "bufio"
+    "strings"
+    "math"
+    "bytes"
 )
 
-var TEST_IMPORTS map[string]string = map[string]string{ "IMPORT": ":imported 57;" }
+var TEST_PACKAGES map[string]string = map[string]string{
+    "IMPORT": ":imported 57;",
+    "NESTED": ":: import; :nested imported 1+;",
+    "LAYERED": ":: nested import; :layered nested imported +;",
+    "CIRCULAR": ":: round;",
+    "ROUND": ":: and round circular;",
+    "AND": "",
+    "PENTA.SCL": "! penta.scl\n!\nfive notes\n 5\n 9/8\n 5/4 a third\n 701.955\n 5/3\n 2/1\n",
+    "BROKEN": ":: import missing;",
+    "DRUM.WAV": string(TEST_WAV),
+}
+
+func TEST_IMPORTS(name string) (string, error) {
+    code, ok := TEST_PACKAGES[name]
+    if !ok {
+        return "", fmt.Errorf("no package %s", name)
+    }
+    return code, nil
+}
 
 func chk(err error) {
     if (err != nil) {
@@ -16,10 +37,20 @@ func chk(err error) {
     }
 }
 
+func test_config(sample_rate float64, save_s float64, workers int) Config {
+    config := DefaultConfig()
+    config.SampleRate = sample_rate
+    config.SaveSeconds = save_s
+    config.Imports = TEST_IMPORTS
+    config.Workers = workers
+    return config
+}
+
 func test(t *testing.T, name string, code string, expect_error bool, expect []float64, debug bool) {
-    DEBUG = debug
+    config := test_config(22050, 1.0, 1)
+    config.Debug = debug
 
-    machine, err := NewMachineString(code, 22050, 1.0, 1, TEST_IMPORTS, 1)
+    machine, err := NewMachineString(code, config)
     if err == nil {
         test_machine(t, name, machine, expect_error, expect)
     } else {
@@ -30,9 +61,10 @@ func test(t *testing.T, name string, code string, expect_error bool, expect []fl
 }
 
 func test_controls(t *testing.T, name string, code string, controls map[string]float64, expect_error bool, expect []float64, debug bool) {
-    DEBUG = debug
+    config := test_config(22050, 1.0, 1)
+    config.Debug = debug
 
-    machine, err := NewMachineString(code, 22050, 1.0, 1, TEST_IMPORTS, 1)
+    machine, err := NewMachineString(code, config)
 
     for k, v := range controls {
         machine.Set(k, v)
@@ -48,14 +80,15 @@ func test_controls(t *testing.T, name string, code string, controls map[string]f
 }
 
 func test_file(t *testing.T, name string, filename string, expect_error bool, expect []float64, debug bool) {
-    DEBUG = debug
+    config := test_config(22050, 1.0, 1)
+    config.Debug = debug
 
     opened_file, err := os.OpenFile(filename, os.O_RDONLY, 0755)
     if err != nil {
         panic(err)
     }
     in := bufio.NewReader( opened_file )
-    machine, err := NewMachine(in, 22050, 1.0, 1, TEST_IMPORTS, 1)
+    machine, err := NewMachine(in, config)
 
     if err == nil {
         test_machine(t, name, machine, expect_error, expect)
@@ -92,16 +125,14 @@ func test_machine(t *testing.T, name string, machine Machine, expect_error bool,
     return
 }
 
-func test_fill32(t *testing.T, name string, filename string, expect_error bool, expect []float32, buf_size int, workers int) {
-    DEBUG = false
-
+func test_fill32(t *testing.T, name string, filename string, expect_error bool, expect []float32, buf_size int, workers int) []float32 {
     opened_file, err := os.OpenFile(filename, os.O_RDONLY, 0755)
     if err != nil {
         panic(err)
     }
 
     in := bufio.NewReader( opened_file )
-    machine, err := NewMachine(in, 22050, 1.0, 1, TEST_IMPORTS, workers)
+    machine, err := NewMachine(in, test_config(22050, 1.0, workers))
     if err != nil {
         panic(err)
     }
@@ -125,13 +156,15 @@ func test_fill32(t *testing.T, name string, filename string, expect_error bool,
         for i, buf_i := range buf {
             if buf_i != expect[i] {
                 t.Errorf("%s : result %f, want %f", name, buf, expect)
-                return
+                return buf
             }
         }
     }
 
     fmt.Printf("%s : filled %d in %s (%d kHz)\n", name, buf_size, elapsed,
             (int64(buf_size) * 1000000 / elapsed.Nanoseconds()))
+
+    return buf
 }
 
 
@@ -288,6 +321,151 @@ func TestNestedChoose(t *testing.T) {
     )
 }
 
+func TestChooseOutOfRange(t *testing.T) {
+    test( t,  "choose out of range",
+              "4 FROM 7, 8 CHOOSE 0 1 - FROM 9, 10 CHOOSE 2 IF 11 ELSE 12 THEN 0 IF 1 FROM 13, 14 CHOOSE THEN 15 .",
+              false, []float64{15},
+              false,
+    )
+}
+
+func TestUnfinishedIf(t *testing.T) {
+    test( t,  "unfinished if",
+              "1 . 0 IF 2 . ELSE 3 .",
+              false, []float64{1, 3},
+              false,
+    )
+}
+
+func TestControlMismatch(t *testing.T) {
+    test_error_pos( t, "then without if", "1 .\n 2 THEN", PHASE_COMPILE, Pos{"", 2, 4}, "THEN" )
+    test_error_pos( t, "choose inside if", "1 IF 2 FROM 3, 4 THEN CHOOSE", PHASE_COMPILE, Pos{"", 1, 18}, "THEN" )
+    test_error_pos( t, "else in from", "1 FROM 2 ELSE 3 CHOOSE", PHASE_COMPILE, Pos{"", 1, 10}, "ELSE" )
+    test_error_pos( t, "loop without do", "LOOP", PHASE_COMPILE, Pos{"", 1, 1}, "LOOP" )
+}
+
+func TestStateInLoop(t *testing.T) {
+    // each pass would share the one PHASE's state, so this isn't allowed
+    test_error_pos( t, "state in loop", "2 0 DO I 1 + 1000 * HZ PHASE . LOOP", PHASE_COMPILE, Pos{"", 1, 24}, "PHASE" )
+    test_error_pos( t, "state in loop word", ": WOB 3 HZ PHASE SIN ;\n 2 0 DO WOB . LOOP", PHASE_COMPILE, Pos{"", 1, 12}, "PHASE" )
+
+    m := NewOpcodeMachine(test_config(22050, 1.0, 1))
+    m.Init(nil)
+    chk(m.Program(strings.NewReader("2 0 DO I . LOOP 1000 HZ PHASE .")))
+}
+
+func TestChannelOutput(t *testing.T) {
+    test( t,  "channel output",
+              "0.5 1 CH 0.25 LEFT 0.125 RIGHT 0.5 0.5 PAN",
+              false, []float64{0.5, 0.25, 0.125, 0.125, 0.375},
+              false,
+    )
+}
+
+func test_interleaved(t *testing.T, name string, code string, channels int, workers int, expect []float32) {
+    machine, err := NewMachineString(code, test_config(22050, 1.0, workers))
+    if err != nil {
+        t.Errorf("%s: unexpected compile error: %v", name, err)
+        return
+    }
+
+    buf := make([]float32, len(expect))
+    err = machine.FillInterleaved32(buf, channels)
+    if err != nil {
+        t.Errorf("%s: unexpected runtime error: %v", name, err)
+        return
+    }
+
+    for i, buf_i := range buf {
+        if buf_i != expect[i] {
+            t.Errorf("%s : result %f, want %f", name, buf, expect)
+            return
+        }
+    }
+}
+
+func TestFillInterleaved(t *testing.T) {
+    code := "0.5 LEFT 0.25 RIGHT 0.125 . 0.5 1 PAN 0.0625 3 CH"
+    test_interleaved( t, "stereo", code, 2, 1, []float32{ 0.625, 0.9375, 0.625, 0.9375 } )
+    test_interleaved( t, "stereo parallel", code, 2, 3, []float32{ 0.625, 0.9375, 0.625, 0.9375, 0.625, 0.9375 } )
+    test_interleaved( t, "mono", code, 1, 1, []float32{ 1.4375, 1.4375 } )
+    test_interleaved( t, "quad", code, 4, 1, []float32{ 0.625, 0.875, 0.125, 0.1875 } )
+}
+
+func TestFillInterleavedBadBuffer(t *testing.T) {
+    machine, err := NewMachineString("0.5 .", test_config(22050, 1.0, 1))
+    chk(err)
+    err = machine.FillInterleaved32( make([]float32, 5), 2 )
+    if err == nil {
+        t.Errorf("fill interleaved bad buffer: expected an error but didn't get one")
+    }
+
+    for _, code := range []string{ "0.5 0 0 MOD CH", "0.5 1 0 MOD CH", "0.5 100000 DUP * DUP * CH", "0.5 0 1 - CH" } {
+        machine, err := NewMachineString(code, test_config(22050, 1.0, 1))
+        chk(err)
+        err = machine.FillInterleaved32( make([]float32, 6), 3 )
+        if err == nil {
+            t.Errorf("fill interleaved %s: expected an error for the channel but didn't get one", code)
+        }
+    }
+}
+
+func TestLoop(t *testing.T) {
+    test( t,  "loop",
+              "4 0 DO I . LOOP",
+              false, []float64{0, 1, 2, 3},
+              false,
+    )
+}
+
+func TestNestedLoop(t *testing.T) {
+    test( t,  "nested loop",
+              "2 0 DO 3 1 DO J 10 * I + . LOOP LOOP",
+              false, []float64{1, 2, 11, 12},
+              false,
+    )
+}
+
+func TestEmptyLoop(t *testing.T) {
+    test( t,  "empty loop",
+              "0 0 DO I . 1 IF 2 . THEN LOOP 5 .",
+              false, []float64{5},
+              false,
+    )
+}
+
+func TestLoopSkipped(t *testing.T) {
+    test( t,  "loop skipped",
+              "0 IF 3 0 DO I . LOOP ELSE 7 . THEN 1 FROM 3 0 DO I . LOOP, 8 . CHOOSE",
+              false, []float64{7, 8},
+              false,
+    )
+}
+
+func TestLoopChoose(t *testing.T) {
+    test( t,  "loop choose",
+              "3 0 DO I FROM 10, 20, 30 CHOOSE . LOOP",
+              false, []float64{10, 20, 30},
+              false,
+    )
+}
+
+func TestLoopLiteral(t *testing.T) {
+    test( t,  "loop literal",
+              "[0 5 1 DO I + LOOP] .",
+              false, []float64{10},
+              false,
+    )
+}
+
+func TestLoopLimit(t *testing.T) {
+    test( t,  "loop limit (error)",
+              "100000 0 DO LOOP",
+              true, nil,
+              false,
+    )
+}
+
 func TestOscillators(t *testing.T) {
     test( t,  "oscillators",
               "0 |0.25 SIN . |0.25 SAW . |0.25 SQ . |0.25 TR . .",
@@ -344,6 +522,822 @@ func TestImport(t *testing.T) {
     )
 }
 
+func TestNestedImport(t *testing.T) {
+    test( t,  "nested import",
+              "::nested; nested.",
+              false, []float64{58},
+              false,
+    )
+}
+
+func TestLayeredImport(t *testing.T) {
+    test( t,  "layered import",
+              "::layered import; layered.",
+              false, []float64{115},
+              false,
+    )
+}
+
+func TestCircularImport(t *testing.T) {
+    test( t,  "circular import (error)",
+              "::circular;",
+              true, nil,
+              false,
+    )
+}
+
+func TestMissingImport(t *testing.T) {
+    _, err := NewMachineString("::nested broken;", test_config(22050, 1.0, 1))
+    if err == nil || !strings.Contains(err.Error(), "BROKEN -> MISSING") {
+        t.Errorf("missing import: error %v should name the import chain", err)
+    }
+}
+
+func test_error_pos(t *testing.T, name string, code string, phase string, pos Pos, word string) {
+    machine, err := NewMachineString(code, test_config(22050, 1.0, 1))
+    if err == nil {
+        _, err = machine.Run()
+    }
+
+    e, ok := err.(*Error)
+    if !ok {
+        t.Errorf("%s : got %v, want a d4 Error", name, err)
+        return
+    }
+
+    if e.Phase != phase || e.Pos != pos || e.Word != word {
+        t.Errorf("%s : got %s error at %s in %q, want %s error at %s in %q", name, e.Phase, e.Pos, e.Word, phase, pos, word)
+    }
+}
+
+func TestErrorPositions(t *testing.T) {
+    test_error_pos( t, "scan error", "1 2 +\n  3 ;", PHASE_SCAN, Pos{"", 2, 5}, ";" )
+    test_error_pos( t, "compile error", ":sound\n\t440 hz T* sine ;\nsound .", PHASE_COMPILE, Pos{"", 2, 12}, "SINE" )
+    test_error_pos( t, "optimize error", "1 [2 ♯ +] .", PHASE_OPTIMIZE, Pos{"", 1, 8}, "+" )
+    test_error_pos( t, "state in literal", "[1000 PHASE] .", PHASE_OPTIMIZE, Pos{"", 1, 7}, "PHASE" )
+    test_error_pos( t, "runtime error", "1 0 /\n.", PHASE_RUNTIME, Pos{"", 1, 5}, "/" )
+    test_error_pos( t, "runtime error in definition", ":x ?;\n 5 x", PHASE_RUNTIME, Pos{"", 1, 4}, "PEEK" )
+    test_error_pos( t, "import error", "::nested broken;", PHASE_PROGRAM, Pos{"BROKEN", 1, 11}, "MISSING" )
+}
+
+func TestEval(t *testing.T) {
+    m := NewOpcodeMachine(test_config(22050, 1.0, 1))
+    m.Init(nil)
+
+    _, _, err := m.Eval(strings.NewReader(":square dup *; ::import;"), 1)
+    chk(err)
+
+    output, stack, err := m.Eval(strings.NewReader("imported square 4 LEFT"), 1)
+    chk(err)
+
+    if len(stack) != 1 || stack[0] != 57*57 || len(output) != 1 || output[0] != (Output{0, 4}) {
+        t.Errorf("eval : stack %v output %v, want [3249] [{0 4}]", stack, output)
+    }
+
+    _, _, err = m.Eval(strings.NewReader(":f control x { 1 0 2 } @ ; f"), -1)
+    if err == nil {
+        t.Errorf("eval : expected an error at iteration -1 but didn't get one")
+    }
+}
+
+func TestEvalAgain(t *testing.T) {
+    // the repl runs every line at the same iteration, so KEEPs and state must be stored afresh each time
+    m := NewOpcodeMachine(test_config(22050, 1.0, 1))
+    m.Init(nil)
+
+    _, _, err := m.Eval(strings.NewReader(": twice 2 * KEEP doubled doubled @ ;"), 1)
+    chk(err)
+
+    var first []float64
+    for i := 0; i < 3; i++ {
+        _, stack, err := m.Eval(strings.NewReader("3 twice 1 1000 0.707 LPF"), 1)
+        chk(err)
+        if first == nil {
+            first = stack
+        }
+        if len(stack) != 2 || stack[0] != 6 || stack[1] != first[1] {
+            t.Errorf("eval again : stack %v the %d time, want %v", stack, i+1, first)
+        }
+    }
+}
+
+func TestReprogram(t *testing.T) {
+    machine, err := NewMachineString("7 keep x x delta .", test_config(22050, 1.0, 1))
+    chk(err)
+
+    test_machine(t, "reprogram before", machine, false, []float64{0})
+    test_machine(t, "reprogram before", machine, false, []float64{7})
+
+    chk(machine.Reprogram(strings.NewReader("9 keep y 3 keep x x delta . y delta ."), 0))
+
+    test_machine(t, "reprogram after", machine, false, []float64{7, 0})
+    test_machine(t, "reprogram after", machine, false, []float64{3, 9})
+
+    err = machine.Reprogram(strings.NewReader("unknown ."), 0)
+    if err == nil {
+        t.Errorf("reprogram : expected compile error")
+    }
+    test_machine(t, "reprogram failed", machine, false, []float64{3, 9})
+}
+
+func TestReprogramState(t *testing.T) {
+    // a filter and a voice's KEEP in the same place in the new program carry on where they were
+    config := test_config(1000, 1.0, 1)
+    config.Polyphony = 1
+    machine, err := NewMachineString(":count ( freq velocity gate age -- n ) DROP DROP DROP DROP c DELTA 1 + DUP KEEP c ;\n"+
+                                     "1 100 0.707 LPF . LIVE VOICES count .", config)
+    chk(err)
+    chk(machine.NoteOn(69, 1))
+    for i := 0; i < 99; i++ {
+        machine.Run()
+    }
+    result, err := machine.Run()
+    chk(err)
+    if math.Abs(result[0] - 1) > 0.01 || result[1] != 100 {
+        t.Errorf("reprogram state : got %v before reprogramming, want about [1 100]", result)
+    }
+
+    chk(machine.Reprogram(strings.NewReader(":count ( freq velocity gate age -- n ) DROP DROP DROP DROP c DELTA 1 + DUP KEEP c ;\n"+
+                                            "1 100 0.707 LPF . LIVE VOICES count . 0.5 ."), 0))
+    result, err = machine.Run()
+    chk(err)
+    if math.Abs(result[0] - 1) > 0.01 || result[1] != 101 || result[2] != 0.5 {
+        t.Errorf("reprogram state : got %v after reprogramming, want about [1 101 0.5]", result)
+    }
+
+    // a program which doesn't compile leaves the controls alone
+    err = machine.Reprogram(strings.NewReader("control fresh { 5 0 10 } @ . unknown"), 0)
+    if err == nil {
+        t.Errorf("reprogram state : expected compile error")
+    }
+    _, ok := machine.GetData().controls["FRESH"]
+    if ok {
+        t.Errorf("reprogram state : failed program set the default of FRESH")
+    }
+}
+
+func TestReprogramCrossfade(t *testing.T) {
+    machine, err := NewMachineString("1 .", test_config(22050, 1.0, 1))
+    chk(err)
+    test_machine(t, "crossfade before", machine, false, []float64{1})
+
+    chk(machine.Reprogram(strings.NewReader("0.5 ."), 4))
+
+    test_machine(t, "crossfade 1", machine, false, []float64{0.125, 0.75})
+    test_machine(t, "crossfade 2", machine, false, []float64{0.25, 0.5})
+    test_machine(t, "crossfade 3", machine, false, []float64{0.375, 0.25})
+    test_machine(t, "crossfade 4", machine, false, []float64{0.5})
+}
+
+func TestTempo(t *testing.T) {
+    machine, err := NewMachineString("BEAT 10 / . TEMPO 1000 / . 1 BPM .", test_config(1000, 1.0, 1))
+    chk(err)
+    loop := DefaultConfig().Loop
+
+    for i := 1; i < 500; i++ {
+        machine.Run()
+    }
+    test_machine(t, "tempo 120", machine, false, []float64{0.1, 0.12, loop / 120 / math.Pi})
+
+    chk(machine.Set("tempo", 60))
+    for i := 501; i < 1000; i++ {
+        machine.Run()
+    }
+    test_machine(t, "tempo 60", machine, false, []float64{0.15, 0.06, loop / 60 / math.Pi})
+
+    if machine.Set("TEMPO", 0) == nil {
+        t.Errorf("tempo : expected error setting tempo to 0")
+    }
+}
+
+func TestConfigDefaults(t *testing.T) {
+    // an empty Config gets the defaults rather than dividing by zero
+    machine, err := NewMachineString("0.5 .", Config{})
+    chk(err)
+    buf := make([]float32, 10)
+    chk(machine.Fill32(buf))
+    if buf[9] != 0.5 {
+        t.Errorf("config defaults : got %v, want 0.5", buf[9])
+    }
+}
+
+func TestConfig(t *testing.T) {
+    just := test_config(22050, 1.0, 1)
+    just.Tuning = JustIntonation()
+
+    equal, err := NewMachineString("15 SHARP 32 / .", test_config(22050, 1.0, 1))
+    chk(err)
+    justly, err := NewMachineString("15 SHARP 32 / .", just)
+    chk(err)
+
+    test_machine(t, "config tuning", justly, false, []float64{0.5})
+    result, err := equal.Run()
+    chk(err)
+    if result[0] == 0.5 {
+        t.Errorf("config tuning : machines share tuning")
+    }
+
+    seeded := test_config(22050, 1.0, 1)
+    seeded.Seed = 42
+    a, err := NewMachineString("NOISE .", seeded)
+    chk(err)
+    b, err := NewMachineString("NOISE .", seeded)
+    chk(err)
+    c, err := NewMachineString("NOISE .", test_config(22050, 1.0, 1))
+    chk(err)
+
+    a_out, _ := a.Run()
+    b_out, _ := b.Run()
+    c_out, _ := c.Run()
+    if a_out[0] != b_out[0] || a_out[0] == c_out[0] {
+        t.Errorf("config seed : got %v, %v with seed 42 and %v with seed 1", a_out, b_out, c_out)
+    }
+
+    if a.GetData().Config().Seed != 42 {
+        t.Errorf("config : machine data has seed %d, want 42", a.GetData().Config().Seed)
+    }
+}
+
+func TestNoise(t *testing.T) {
+    run := func(code string, workers int) []float32 {
+        machine, err := NewMachineString(code, test_config(22050, 1.0, workers))
+        chk(err)
+        buf := make([]float32, 2000)
+        chk(machine.Fill32(buf))
+        return buf
+    }
+
+    white := run("NOISE .", 1)
+    low, high := float32(0), float32(0)
+    for _, v := range white {
+        if v < low {
+            low = v
+        }
+        if v > high {
+            high = v
+        }
+    }
+    if low < -1 || low > -0.9 || high > 1 || high < 0.9 {
+        t.Errorf("noise : white noise from %v to %v, want -1 to 1", low, high)
+    }
+
+    for _, code := range []string{"NOISE 0.5 * PINK 0.5 * + .", "BROWN .", "100HZ T* SH ."} {
+        single, parallel := run(code, 1), run(code, 4)
+        for i := range single {
+            if single[i] != parallel[i] {
+                t.Errorf("noise %s : sample %d is %v with 4 workers, %v with 1", code, i, parallel[i], single[i])
+                break
+            }
+        }
+    }
+
+    // redder noise changes less from one sample to the next
+    smoothness := func(buf []float32) float64 {
+        sum, diff := 0.0, 0.0
+        for i := 1; i < len(buf); i++ {
+            sum += float64(buf[i] * buf[i])
+            diff += float64((buf[i] - buf[i-1]) * (buf[i] - buf[i-1]))
+        }
+        return sum / diff
+    }
+    if !(smoothness(white) < smoothness(run("PINK .", 1)) && smoothness(run("PINK .", 1)) < smoothness(run("BROWN .", 1))) {
+        t.Errorf("noise : white, pink and brown not getting smoother")
+    }
+
+    if run("NOISE NOISE - .", 1)[0] == 0 {
+        t.Errorf("noise twice : both NOISEs gave the same value")
+    }
+
+    // the same place in the code, with different seeds
+    seeded, unseeded, other := run("1 SEED NOISE .", 1), run("1 DROP NOISE .", 1), run("2 SEED NOISE .", 1)
+    if seeded[0] != unseeded[0] || seeded[0] == other[0] {
+        t.Errorf("noise seed : got %v with 1 SEED, %v with the config's seed of 1 and %v with 2 SEED", seeded[0], unseeded[0], other[0])
+    }
+
+    held := run("100HZ T* SH .", 1)
+    if held[0] != held[100] || held[0] == held[300] {
+        t.Errorf("noise : sample and hold gave %v, %v, %v", held[0], held[100], held[300])
+    }
+}
+
+func TestNoteNames(t *testing.T) {
+    test( t,  "note names",
+              "A4 1 HZ / 1000 / . A3 1HZ/1000/. TUNING JUST C#5 1HZ/1000/.",
+              false, []float64{0.44, 0.22, 0.55},
+              false,
+    )
+    test( t,  "note names pythagorean",
+              "TUNING PYTHAGOREAN EB5 1 HZ / 1000 / .",
+              false, []float64{0.626484375},
+              false,
+    )
+    test( t,  "note names apart", "A 4 .", true, nil, false )
+    test( t,  "note names defined",
+              ":A 1; A4 + .",
+              false, []float64{5},
+              false,
+    )
+    test( t,  "edo",
+              "TUNING 5EDO 1 SHARP 2 / .",
+              false, []float64{math.Pow(2, 1.0/5) / 2},
+              false,
+    )
+}
+
+func TestScala(t *testing.T) {
+    test( t,  "scala",
+              "TUNING penta B4 1 HZ / 1000 / . 1 SHARP .",
+              false, []float64{0.495, 1.125},
+              false,
+    )
+    test( t,  "scala missing", "TUNING nowhere 1 .", true, nil, false )
+    test( t,  "tuning in definition", ":x TUNING JUST; 1 .", true, nil, false )
+
+    _, err := ParseScala("! bad\nbad\n 2\n 9/8\n")
+    if err == nil {
+        t.Errorf("scala : expected error for missing pitch")
+    }
+}
+
+/* A two track MIDI file at 480 ticks a beat and 120 beats a minute. Track 1 plays
+   A4 for half a second and C#5 (velocity 127) for a second, both from the start,
+   then A4 again at 1.5s until the end of the track at 2s */
+var TEST_MIDI = []byte{
+    'M', 'T', 'h', 'd', 0, 0, 0, 6, 0, 1, 0, 2, 0x01, 0xe0,
+    'M', 'T', 'r', 'k', 0, 0, 0, 11,
+    0x00, 0xff, 0x51, 0x03, 0x07, 0xa1, 0x20,
+    0x00, 0xff, 0x2f, 0x00,
+    'M', 'T', 'r', 'k', 0, 0, 0, 26,
+    0x00, 0x90, 69, 64,
+    0x00, 73, 127,             // running status
+    0x83, 0x60, 0x80, 69, 0,
+    0x83, 0x60, 73, 0,
+    0x83, 0x60, 0x90, 69, 100, // never let go
+    0x83, 0x60, 0xff, 0x2f, 0x00,
+}
+
+func TestMIDI(t *testing.T) {
+    machine, err := NewMachineString("1 0 NOTE 1 HZ / 1000 / . 1 0 GATE . 1 1 GATE . 1 1 VELOCITY . 1 0 AGE 1 S / . 2 0 GATE .", test_config(1000, 1.0, 1))
+    chk(err)
+    chk(machine.LoadMIDI(bytes.NewReader(TEST_MIDI)))
+
+    for i := 1; i < 250; i++ {
+        machine.Run()
+    }
+    test_machine(t, "midi 0.25s", machine, false, []float64{0.44, 1, 1, 1, 0.25, 0})
+
+    for i := 251; i < 750; i++ {
+        machine.Run()
+    }
+    test_machine(t, "midi 0.75s", machine, false, []float64{0.44, 0, 1, 1, 0.75, 0})
+
+    for i := 751; i < 1750; i++ {
+        machine.Run()
+    }
+    test_machine(t, "midi 1.75s", machine, false, []float64{0.44, 1, 0, 1, 0.25, 0})
+
+    for i := 1751; i < 2500; i++ {
+        machine.Run()
+    }
+    test_machine(t, "midi 2.5s", machine, false, []float64{0.44, 0, 0, 1, 1, 0})
+
+    err = machine.LoadMIDI(bytes.NewReader(TEST_MIDI[:30]))
+    if err == nil {
+        t.Errorf("midi : expected error reading truncated file")
+    }
+
+    huge := append(append([]byte{}, TEST_MIDI[:14]...), "MTrk\xff\xff\xff\xf0"...)
+    err = machine.LoadMIDI(bytes.NewReader(huge))
+    if err == nil {
+        t.Errorf("midi : expected error reading a track longer than the file")
+    }
+}
+
+func TestVoices(t *testing.T) {
+    config := test_config(1000, 1.0, 1)
+    config.Polyphony = 2
+    machine, err := NewMachineString(":count ( freq velocity gate age -- n ) DROP DROP DROP DROP c DELTA 1 + DUP KEEP c ;\n"+
+                                     ":held DROP NIP NIP ;\n"+
+                                     "LIVE VOICES count . LIVE VOICES count 10 * . LIVE VOICES held .", config)
+    chk(err)
+
+    test_machine(t, "voices none", machine, false, []float64{0, 0, 0})
+
+    chk(machine.NoteOn(69, 1))
+    machine.Run()
+    machine.Run()
+    test_machine(t, "voices one", machine, false, []float64{3, 30, 1})
+
+    chk(machine.NoteOn(73, 0.5))
+    test_machine(t, "voices two", machine, false, []float64{5, 50, 2})
+
+    // steals the first voice, which keeps counting
+    chk(machine.NoteOn(76, 0.5))
+    test_machine(t, "voices stolen", machine, false, []float64{7, 70, 2})
+
+    chk(machine.NoteOff(73))
+    test_machine(t, "voices off", machine, false, []float64{9, 90, 1})
+
+    midi, err := NewMachineString(":held DROP NIP NIP ; 1 VOICES held . 1 0 NOTE 1 HZ / 1000 / .", test_config(1000, 1.0, 1))
+    chk(err)
+    chk(midi.LoadMIDI(bytes.NewReader(TEST_MIDI)))
+    for i := 1; i < 250; i++ {
+        midi.Run()
+    }
+    test_machine(t, "voices midi", midi, false, []float64{2, 0.44})
+
+    _, err = NewMachineString("1 VOICES NOPE .", config)
+    if err == nil {
+        t.Errorf("voices : expected compile error for undefined patch")
+    }
+}
+
+func TestEnvelope(t *testing.T) {
+    machine, err := NewMachineString("T key 0.01S 0.01S 0.5 0.02S ADSR . :key control held @;", test_config(1000, 1.0, 1))
+    chk(err)
+    chk(machine.Set("held", 1))
+
+    expect := map[int]float64{ 5: 0.5, 15: 0.75, 25: 0.5, 36: 0.25, 46: 0, 50: 0 }
+    for i := 1; i <= 50; i++ {
+        if i == 26 {
+            chk(machine.Set("held", 0))
+        }
+        result, err := machine.Run()
+        chk(err)
+        want, ok := expect[i]
+        if ok && math.Abs(result[0] - want) > 1e-9 {
+            t.Errorf("envelope : level %v at %d, want %v", result[0], i, want)
+        }
+    }
+}
+
+func TestStatefulSingle(t *testing.T) {
+    // words which keep state run a sample at a time, however many workers there are
+    cases := []struct{ code string; parallel bool }{
+        { "A4 T* SIN .", true },
+        { "0.01S 0.02S T ON IF 1 ELSE 0 0 THEN 0.005S 0.01S AR .", false },
+        { "110HZ T* SAW 800 2 LPF 2000 1 HPF .", false },
+        { "A4 PHASE SIN .", false },
+        { "A4 T* SIN 2* . 0.5 CLIP", false },
+    }
+
+    for _, c := range cases {
+        m := NewOpcodeMachine(test_config(22050, 1.0, 4))
+        m.Init(nil)
+        chk(m.Program(strings.NewReader(c.code)))
+        if m.parallel() != c.parallel {
+            t.Errorf("stateful %s : parallel is %v, want %v", c.code, m.parallel(), c.parallel)
+        }
+    }
+
+    machine, err := NewMachineString(cases[1].code, test_config(22050, 1.0, 4))
+    chk(err)
+    buf := make([]float32, 1000)
+    chk(machine.Fill32(buf))
+    if buf[400] != 1 || buf[999] != 0 {
+        t.Errorf("stateful : envelope got %v during the note and %v after with 4 workers", buf[400], buf[999])
+    }
+}
+
+func TestFilters(t *testing.T) {
+    cases := []struct{ code string; want float64 }{
+        { "1 1000 0.707 LPF .", 1 },
+        { "1 1000 0.707 HPF .", 0 },
+        { "1 1000 1 BPF .", 0 },
+        { "1 1000 1 NOTCH .", 1 },
+        { "1 1000 1 6 PEAK .", 1 },
+        { "1 1000 0.707 0 6 - LOSHELF .", math.Pow(10, -6.0 / 20) },
+        { "1 1000 0.707 6 HISHELF .", 1 },
+    }
+
+    for _, c := range cases {
+        machine, err := NewMachineString(c.code, test_config(22050, 1.0, 1))
+        chk(err)
+        buf := make([]float32, 4000)
+        chk(machine.Fill32(buf))
+        if math.Abs(float64(buf[len(buf)-1]) - c.want) > 1e-4 {
+            t.Errorf("filter %s : settled at %v, want %v", c.code, buf[len(buf)-1], c.want)
+        }
+    }
+
+    _, _, err := NewOpcodeMachine(test_config(22050, 1.0, 1)).Eval(strings.NewReader("1 1000 0 LPF"), 1)
+    if err == nil {
+        t.Errorf("filter : expected an error for Q of 0 but didn't get one")
+    }
+}
+
+func TestDelays(t *testing.T) {
+    // an impulse at sample 10, then what comes out at samples 10...30
+    impulse := "0.0095S 0.0009S T ON IF DROP 1 ELSE 0 THEN "
+    cases := []struct{ code string; want map[int]float64 }{
+        { impulse + "0.005S DELAY .", map[int]float64{ 10: 0, 15: 1, 16: 0 } },
+        { impulse + "0.0055S DELAY .", map[int]float64{ 15: 0.5, 16: 0.5, 17: 0 } },
+        { impulse + "0.005S 0.5 ECHO .", map[int]float64{ 10: 1, 15: 0.5, 20: 0.25, 21: 0 } },
+        { impulse + "0.005S 0.5 COMB .", map[int]float64{ 10: 0, 15: 1, 20: 0.5, 25: 0.25 } },
+        { impulse + "0.005S 0.5 ALLPASS .", map[int]float64{ 10: 0 - 0.5, 15: 0.75, 20: 0.375 } },
+    }
+
+    for _, c := range cases {
+        machine, err := NewMachineString(c.code, test_config(1000, 1.0, 1))
+        chk(err)
+        for i := 1; i <= 30; i++ {
+            result, err := machine.Run()
+            chk(err)
+            want, ok := c.want[i]
+            if ok && math.Abs(result[0] - want) > 1e-9 {
+                t.Errorf("delay %s : %v at %d, want %v", c.code, result[0], i, want)
+            }
+        }
+    }
+
+    machine, err := NewMachineString("1 2S DELAY .", test_config(1000, 1.0, 1))
+    chk(err)
+    _, err = machine.Run()
+    if err == nil {
+        t.Errorf("delay : expected an error for a delay longer than MaxDelay but didn't get one")
+    }
+
+    config := test_config(1000, 1.0, 1)
+    config.MaxDelay = 3
+    machine, err = NewMachineString("1 2S DELAY .", config)
+    chk(err)
+    _, err = machine.Run()
+    chk(err)
+
+    // skipped by IF for more than the length of the buffer, which mustn't replay what's in it from before
+    machine, err = NewMachineString(":delayed control going @; delayed IF 1 0.5S DELAY ELSE 0 THEN .", test_config(1000, 1.0, 1))
+    chk(err)
+    for i := 1; i <= 2100; i++ {
+        switch i {
+            case 1:
+                chk(machine.Set("going", 1))
+            case 101:
+                chk(machine.Set("going", 0))
+            case 1501:
+                chk(machine.Set("going", 1))
+        }
+        result, err := machine.Run()
+        chk(err)
+        want := 0.0
+        if i > 2000 {
+            want = 1
+        }
+        if math.Abs(result[0] - want) > 1e-6 {
+            t.Errorf("delay in IF : %v at %d, want %v", result[0], i, want)
+            break
+        }
+    }
+
+    // a voice starting a new note doesn't hear the last one
+    config = test_config(1000, 1.0, 1)
+    config.Polyphony = 1
+    machine, err = NewMachineString(":delayed ( freq velocity gate age -- out ) DROP DROP DROP DROP 1 0.1S DELAY ; LIVE VOICES delayed .", config)
+    chk(err)
+    chk(machine.NoteOn(69, 1))
+    for i := 1; i <= 300; i++ {
+        if i == 150 {
+            chk(machine.NoteOn(72, 1))
+        }
+        result, err := machine.Run()
+        chk(err)
+        want := 0.0
+        if (i > 100 && i < 150) || i >= 250 {
+            want = 1
+        }
+        if math.Abs(result[0] - want) > 1e-6 {
+            t.Errorf("delay in voice : %v at %d, want %v", result[0], i, want)
+            break
+        }
+    }
+}
+
+func TestBandLimited(t *testing.T) {
+    // 2205 samples hold exactly 300 cycles of 3000Hz, so the harmonics below Nyquist
+    // can be taken out and whatever is left is aliasing
+    freq, rate, n := 3000.0, 22050.0, 2205
+
+    aliasing := func(code string) float64 {
+        machine, err := NewMachineString(code, test_config(rate, 1.0, 1))
+        chk(err)
+        values := make([]float64, n)
+        for i := range values {
+            result, err := machine.Run()
+            chk(err)
+            values[i] = result[0]
+        }
+
+        power, dc := 0.0, 0.0
+        for _, v := range values {
+            power += v * v / float64(n)
+            dc += v / float64(n)
+        }
+        power -= dc * dc
+        for k := 1.0; k * freq < rate / 2; k++ {
+            a, b := 0.0, 0.0
+            for i, v := range values {
+                angle := 2 * math.Pi * k * freq * float64(i+1) / rate
+                a += 2 * v * math.Cos(angle) / float64(n)
+                b += 2 * v * math.Sin(angle) / float64(n)
+            }
+            power -= (a * a + b * b) / 2
+        }
+        return math.Sqrt(math.Max(power, 0))
+    }
+
+    cases := []struct{ naive string; limited string }{
+        { "3000HZ T* RAMP .", "3000HZ DUP T* BLSAW ." },
+        { "3000HZ T* SQ .", "3000HZ DUP T* BLSQ ." },
+        { "0.6 3000HZ T* PULSE .", "0.6 3000HZ DUP T* BLPULSE ." },
+        { "3000HZ T* TR .", "3000HZ DUP T* BLTR ." },
+    }
+
+    for _, c := range cases {
+        naive, limited := aliasing(c.naive), aliasing(c.limited)
+        if limited > naive / 2 {
+            t.Errorf("band limited %s : aliasing %v, no better than %v from %s", c.limited, limited, naive, c.naive)
+        }
+    }
+}
+
+/* Four samples of 16 bit mono at 1000Hz: 0, 0.5, -0.5, 0.25 */
+var TEST_WAV = []byte{
+    'R', 'I', 'F', 'F', 44, 0, 0, 0, 'W', 'A', 'V', 'E',
+    'f', 'm', 't', ' ', 16, 0, 0, 0, 1, 0, 1, 0, 0xe8, 0x03, 0, 0, 0xd0, 0x07, 0, 0, 2, 0, 16, 0,
+    'd', 'a', 't', 'a', 8, 0, 0, 0, 0, 0, 0x00, 0x40, 0x00, 0xc0, 0x00, 0x20,
+}
+
+func TestSamples(t *testing.T) {
+    code := "SAMPLE drum  0S 1S T ON DROP  DUP drum SWAP 1 PLAY .  DUP drum SWAP 0.5 PLAY .  drum SWAP 1 LOOPED .  drum 250HZ T* WAVE ."
+    machine, err := NewMachineString(code, test_config(1000, 1.0, 1))
+    chk(err)
+
+    expect := [][]float64{
+        { 0.5, 0.25, 0.5, 0.5 },
+        { -0.5, 0.5, -0.5, -0.5 },
+        { 0.25, 0, 0.25, 0.25 },
+        { 0, -0.5, 0, 0 },
+        { 0, -0.125, 0.5, 0.5 },
+    }
+    for i, want := range expect {
+        result, err := machine.Run()
+        chk(err)
+        for j := range want {
+            if math.Abs(result[j] - want[j]) > 1e-9 {
+                t.Errorf("samples : got %v at %d, want %v", result, i+1, want)
+                break
+            }
+        }
+    }
+
+    _, err = NewMachineString("SAMPLE missing", test_config(1000, 1.0, 1))
+    if err == nil {
+        t.Errorf("samples : expected an error for a missing sample but didn't get one")
+    }
+    _, err = NewMachineString(":drum SAMPLE drum ;", test_config(1000, 1.0, 1))
+    if err == nil {
+        t.Errorf("samples : expected an error for SAMPLE inside a definition but didn't get one")
+    }
+
+    // loading the same sample again replaces it, rather than keeping every copy
+    m := NewOpcodeMachine(test_config(1000, 1.0, 1))
+    m.Init(nil)
+    chk(m.Program(strings.NewReader("SAMPLE drum drum DROP")))
+    chk(m.Program(strings.NewReader("SAMPLE drum drum DROP")))
+    for i := 0; i < 3; i++ {
+        _, stack, err := m.Eval(strings.NewReader("SAMPLE drum drum"), 1)
+        chk(err)
+        if len(stack) != 1 || stack[0] != 0 {
+            t.Errorf("samples : drum is %v after loading it again, want [0]", stack)
+        }
+    }
+    if len(m.tables) != 1 {
+        t.Errorf("samples : %d tables after loading drum again, want 1", len(m.tables))
+    }
+
+    _, err = ReadWAV(bytes.NewReader([]byte{
+        'R', 'I', 'F', 'F', 12, 0, 0, 0, 'W', 'A', 'V', 'E',
+        'd', 'a', 't', 'a', 0xf0, 0xff, 0xff, 0xff, 0, 0,
+    }))
+    if err == nil {
+        t.Errorf("samples : expected an error for a chunk longer than the file but didn't get one")
+    }
+
+    // 24 bit stereo, after a chunk of odd length
+    table, err := ReadWAV(bytes.NewReader([]byte{
+        'R', 'I', 'F', 'F', 54, 0, 0, 0, 'W', 'A', 'V', 'E',
+        'L', 'I', 'S', 'T', 3, 0, 0, 0, 'a', 'b', 'c', 0,
+        'f', 'm', 't', ' ', 16, 0, 0, 0, 1, 0, 2, 0, 0xe8, 0x03, 0, 0, 0x70, 0x17, 0, 0, 6, 0, 24, 0,
+        'd', 'a', 't', 'a', 6, 0, 0, 0, 0, 0, 0x40, 0, 0, 0x20,
+    }))
+    chk(err)
+    if len(table.Samples) != 1 || table.Samples[0] != 0.375 || table.SampleRate != 1000 {
+        t.Errorf("samples : read %v at %v, want [0.375] at 1000", table.Samples, table.SampleRate)
+    }
+}
+
+func TestOperators(t *testing.T) {
+    // at 1000Hz, 250Hz goes a quarter of the way round each sample
+    code := "250HZ 0 OP .  250HZ 0 OP 250HZ SWAP OP .  250HZ 0 1 OPFB ."
+    machine, err := NewMachineString(code, test_config(1000, 1.0, 1))
+    chk(err)
+
+    expect := [][]float64{
+        { 0, 0, 0 },
+        { 1, math.Cos(1), 1 },
+        { 0, 0, -math.Sin(0.5) },
+    }
+    for i, want := range expect {
+        result, err := machine.Run()
+        chk(err)
+        for j := range want {
+            if math.Abs(result[j] - want[j]) > 1e-9 {
+                t.Errorf("operators : got %v at %d, want %v", result, i+1, want)
+                break
+            }
+        }
+    }
+
+    // changing frequency doesn't make the wave jump
+    machine, err = NewMachineString("freq HZ 0 OP . :freq control pitch @;", test_config(22050, 1.0, 1))
+    chk(err)
+    chk(machine.Set("pitch", 100))
+    last := 0.0
+    for i := 1; i < 1000; i++ {
+        if i == 500 {
+            chk(machine.Set("pitch", 150))
+        }
+        result, err := machine.Run()
+        chk(err)
+        if math.Abs(result[0] - last) > 2 * math.Pi * 150 / 22050 {
+            t.Errorf("operators : jumped from %v to %v at %d", last, result[0], i)
+            break
+        }
+        last = result[0]
+    }
+}
+
+func TestPhase(t *testing.T) {
+    test( t,  "phase", "250HZ PHASE SIN . 250HZ PHASE 250HZ PHASE + .", false, []float64{0, 0}, false )
+
+    machine, err := NewMachineString("freq HZ PHASE SIN . :freq control pitch @;", test_config(22050, 1.0, 1))
+    chk(err)
+    buf := make([]float32, 2000)
+    chk(machine.Set("pitch", 100))
+    chk(machine.Fill32(buf[:1000]))
+    chk(machine.Set("pitch", 150))
+    chk(machine.Fill32(buf[1000:]))
+    for i := 1; i < len(buf); i++ {
+        if math.Abs(float64(buf[i] - buf[i-1])) > 2 * math.Pi * 150 / 22050 {
+            t.Errorf("phase : jumped from %v to %v at %d", buf[i-1], buf[i], i)
+            break
+        }
+    }
+}
+
+func TestSmoothing(t *testing.T) {
+    // at 1000Hz, 0.01S is 10 samples
+    machine, err := NewMachineString("level 0.01S GLIDE . level 0.01S LAG . level . :level control target @;", test_config(1000, 1.0, 1))
+    chk(err)
+    chk(machine.Set("target", 1))
+
+    expect := map[int][]float64{
+        1: { 1, 1, 1 },
+        10: { 1, 1, 1 },
+        11: { 1, 3 - 2 * math.Exp(-0.1), 3 },
+        16: { 2, 3 - 2 * math.Exp(-0.6), 3 },
+        21: { 3, 3 - 2 * math.Exp(-1.1), 3 },
+    }
+    for i := 1; i <= 21; i++ {
+        if i == 11 {
+            chk(machine.Set("target", 3))
+        }
+        result, err := machine.Run()
+        chk(err)
+        want, ok := expect[i]
+        if ok {
+            for j := range want {
+                if math.Abs(result[j] - want[j]) > 1e-9 {
+                    t.Errorf("smoothing : got %v at %d, want %v", result, i, want)
+                    break
+                }
+            }
+        }
+    }
+
+    config := test_config(1000, 1.0, 4)
+    config.Smoothing = 0.01
+    machine, err = NewMachineString("level . :level control target @;", config)
+    chk(err)
+    chk(machine.Set("target", 0.25))
+    buf := make([]float32, 10)
+    chk(machine.Fill32(buf))
+    chk(machine.Set("target", 0.5))
+    chk(machine.Fill32(buf))
+    if buf[0] == 0.5 || math.Abs(float64(buf[9]) - (0.5 - 0.25 * math.Exp(-1))) > 1e-6 {
+        t.Errorf("smoothing : control went %v...%v, want to get to %v", buf[0], buf[9], 0.5 - 0.25 * math.Exp(-1))
+    }
+}
+
 func TestConstant(t *testing.T) {
     test( t,  "constant",
               ":sub 47 dup constant this! 11 +; sub. this? this.",
@@ -394,12 +1388,72 @@ func TestControlNotDefined(t *testing.T) {
 }
 
 func TestControlAlreadyDefined(t *testing.T) {
-    test_controls( t,  "control-already-defined",
-              "40 constant mycontrol!",
-              map[string]float64{ "mycontrol": 232 },
-              true, nil,
-              false,
-    )
+    // a CONSTANT the program stores to isn't a control, so it can't be Set as well
+    machine, err := NewMachineString("40 constant mycontrol! mycontrol?", test_config(22050, 1.0, 1))
+    chk(err)
+    if machine.Set("mycontrol", 232) == nil {
+        t.Errorf("control-already-defined : expected an error setting a stored constant but didn't get one")
+    }
+    if len(machine.Controls()) != 0 {
+        t.Errorf("control-already-defined : got controls %v, want none", machine.Controls())
+    }
+    test_machine(t, "control-already-defined", machine, false, []float64{40})
+}
+
+func TestControlInfo(t *testing.T) {
+    code := ":cut control cutoff { 800 20 20000 Hz } @; :res control q { 0.7 0.1 10 } @; :other control raw @;\n" +
+            "cut . res . control spread { 0 -1 1 } ? control gain { -6 -1e2 +12 dB } ?"
+    machine, err := NewMachineString(code, test_config(22050, 1.0, 1))
+    chk(err)
+
+    want := []ControlInfo{
+        ControlInfo{"CUTOFF", 800, 20, 20000, "Hz"},
+        ControlInfo{"Q", 0.7, 0.1, 10, ""},
+        ControlInfo{"RAW", math.NaN(), math.Inf(-1), math.Inf(1), ""},
+        ControlInfo{"SPREAD", 0, -1, 1, ""},
+        ControlInfo{"GAIN", -6, -100, 12, "dB"},
+    }
+    got := machine.Controls()
+    if len(got) != len(want) {
+        t.Errorf("control info : got %v, want %v", got, want)
+    } else {
+        for i := range want {
+            same_default := got[i].Default == want[i].Default || (math.IsNaN(got[i].Default) && math.IsNaN(want[i].Default))
+            if got[i].Name != want[i].Name || !same_default || got[i].Min != want[i].Min || got[i].Max != want[i].Max || got[i].Unit != want[i].Unit {
+                t.Errorf("control info : got %v, want %v", got[i], want[i])
+            }
+        }
+    }
+    test_machine(t, "control info defaults", machine, false, []float64{800, 0.7, 0, -6})
+
+    if machine.Set("cutoff", 5) == nil {
+        t.Errorf("control info : expected an error setting cutoff below its range but didn't get one")
+    }
+    if machine.Set("nothing", 1) == nil {
+        t.Errorf("control info : expected an error setting a control which isn't declared but didn't get one")
+    }
+    if machine.Set("spread", -1.5) == nil {
+        t.Errorf("control info : expected an error setting spread below -1 but didn't get one")
+    }
+    chk(machine.Set("cutoff", 1000))
+    chk(machine.Set("raw", -5))
+    chk(machine.Set("spread", -0.5))
+    test_machine(t, "control info set", machine, false, []float64{1000, 0.7, -0.5, -6})
+
+    for _, bad := range []string{
+        ":cut control cutoff { 800 20 } @;",
+        ":cut control cutoff { 10 20 20000 } @;",
+        ":cut control cutoff { 800 20 high } @;",
+        ":cut control cutoff { 800 20 20000 @;",
+        ":cut { 800 20 20000 } 1 ;",
+        "control spread { 0 - 1 1 }",
+        "control spread { 0 1e 1 }",
+    } {
+        _, err := NewMachineString(bad, test_config(22050, 1.0, 1))
+        if err == nil {
+            t.Errorf("control info : expected an error for %s but didn't get one", bad)
+        }
+    }
 }
 
 func TestOld(t *testing.T) {
@@ -420,6 +1474,74 @@ func TestDelta(t *testing.T) {
     )
 }
 
+func TestFill32Parallel(t *testing.T) {
+    single := test_fill32( t, "chord single", "tests/chord.d4", false, nil, 1000, 1 )
+
+    for _, workers := range []int{ 2, 3, 4 } {
+        name := fmt.Sprintf("chord parallel-%d", workers)
+        test_fill32( t, name, "tests/chord.d4", false, single, 1000, workers )
+    }
+}
+
+func TestFill32ParallelError(t *testing.T) {
+    machine, err := NewMachineString( "47.3", test_config(22050, 1.0, 4) )
+    chk(err)
+    err = machine.Fill32( make([]float32, 10) )
+    if err == nil {
+        t.Errorf("fill32 parallel error: expected an error but didn't get one")
+    }
+}
+
+func benchmark_fill32(b *testing.B, filename string, workers int) {
+    opened_file, err := os.OpenFile(filename, os.O_RDONLY, 0755)
+    chk(err)
+    defer opened_file.Close()
+
+    machine, err := NewMachine(bufio.NewReader(opened_file), test_config(22050, 1.0, workers))
+    chk(err)
+    machine.Set("cutoff", 800)
+
+    buf := make([]float32, 1024)
+
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        chk(machine.Fill32(buf))
+    }
+    b.ReportMetric(float64(b.N * len(buf)) / b.Elapsed().Seconds(), "samples/s")
+}
+
+func BenchmarkFill32Chord(b *testing.B) {
+    benchmark_fill32(b, "tests/chord.d4", 1)
+}
+
+func BenchmarkFill32Filter(b *testing.B) {
+    benchmark_fill32(b, "tests/filter.d4", 1)
+}
+
+func BenchmarkFill32FilterParallel(b *testing.B) {
+    benchmark_fill32(b, "tests/filter.d4", 4)
+}
+
+func TestOldHistory(t *testing.T) {
+    // 100Hz and 0.05s of saves, so 5 iterations of history
+    machine, err := NewMachineString("c delta 1 + dup keep c . c 0.02 s old . c 0.04 s old . c 0.05 s old .", test_config(100, 0.05, 1))
+    chk(err)
+
+    for i := 1; i < 10; i++ {
+        machine.Run()
+    }
+
+    test_machine(t, "old history", machine, false, []float64{10, 8, 6, 0})
+}
+
+func TestPokeNotSaveName(t *testing.T) {
+    test( t,  "poke not a save name (error)",
+              "5 3 !",
+              true, nil,
+              false,
+    )
+}
+
 /*
 const BENCHMARK_FILE = "tests/gloucester.d4"
 
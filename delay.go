@@ -0,0 +1,130 @@
+package d4
+
+import "math"
+
+/* A delay word keeps one state slot, which names its buffer in delays */
+const DELAY_STATE = 1
+
+/* A delay word's buffer, with the iteration each value in it was written at, and
+   the note playing then, so that anything written at another time or for another
+   note reads as silence */
+type DelayLine struct {
+    values []float64
+    written []int64
+    notes []int64
+}
+
+/* Make a buffer, MaxDelay long, for every delay word and every voice's copy of one,
+   keeping any which are already there */
+
+func (m *OpcodeMachine) resize_delays() {
+    length := int(math.Ceil(m.config.MaxDelay * m.config.SampleRate)) + 2
+
+    delays := make([]*DelayLine, m.state_slots)
+    copy(delays, m.delays)
+
+    for _, slot := range m.delay_slots {
+        if delays[slot] == nil {
+            delays[slot] = new_delay_line(length)
+        }
+        for _, moved := range m.voice_states {
+            if slot < len(moved) && delays[moved[slot]] == nil {
+                delays[moved[slot]] = new_delay_line(length)
+            }
+        }
+    }
+
+    m.delays = delays
+}
+
+func new_delay_line( length int ) *DelayLine {
+    line := &DelayLine{make([]float64, length), make([]int64, length), make([]int64, length)}
+    for i := range line.written {
+        line.written[i] = -1
+    }
+    return line
+}
+
+/* The buffer of the delay word with its state at addr */
+
+func (m *OpcodeMachine) delay_line( addr float64, block int ) *DelayLine {
+    slot := int(addr)
+    if block > 0 && slot < len(m.voice_states[block-1]) {
+        slot = m.voice_states[block-1][slot]
+    }
+    return m.delays[slot]
+}
+
+/* How many samples back a delay of time (in the same units as S) is,
+   or an error message if the buffer isn't long enough */
+
+func (m *OpcodeMachine) delay_samples( time float64, line *DelayLine ) (float64, string) {
+    back := time * m.config.SampleRate * m.config.Loop / (2*math.Pi)
+    if back < 0 {
+        return 0, "delay can't be negative"
+    }
+    if back > float64(len(line.values) - 2) {
+        return 0, "delay is longer than MaxDelay"
+    }
+    return back, ""
+}
+
+/* The value written to line at iteration then while playing note, or 0 if nothing was */
+
+func (line *DelayLine) at( then int64, note int64 ) float64 {
+    if then < 0 {
+        return 0
+    }
+    i := then % int64(len(line.values))
+    if line.written[i] != then || line.notes[i] != note {
+        return 0
+    }
+    return line.values[i]
+}
+
+/* The value written to line `back` samples before iter, between samples if back isn't whole */
+
+func delay_read( line *DelayLine, iter int64, back float64, note int64 ) float64 {
+    whole := math.Floor(back)
+    frac := back - whole
+    then := iter - int64(whole)
+    return line.at(then, note) * (1 - frac) + line.at(then - 1, note) * frac
+}
+
+func delay_write( line *DelayLine, iter int64, value float64, note int64 ) {
+    i := iter % int64(len(line.values))
+    line.values[i], line.written[i], line.notes[i] = value, iter, note
+}
+
+/* One sample of the delay word w. DELAY is the input from `back` samples ago;
+   ECHO adds repeats of itself, each `amount` times the last; COMB gives only the
+   repeats, as in a Schroeder reverb; ALLPASS smears the input in time without
+   colouring it. The feedback words can't look back less than one sample.
+   note is when the voice's note started (or -1 outside VOICES), so that a voice
+   doesn't hear the last note it played */
+
+func (m *OpcodeMachine) delay( iter int64, line *DelayLine, w int, in float64, back float64, amount float64, note int64 ) float64 {
+    if w != W_DELAY && back < 1 {
+        back = 1
+    }
+
+    switch w {
+        case W_DELAY:
+            delay_write(line, iter, in, note)
+            return delay_read(line, iter, back, note)
+        case W_ECHO:
+            out := in + amount * delay_read(line, iter, back, note)
+            delay_write(line, iter, out, note)
+            return out
+        case W_COMB:
+            out := delay_read(line, iter, back, note)
+            delay_write(line, iter, in + amount * out, note)
+            return out
+        case W_ALLPASS:
+            old := delay_read(line, iter, back, note)
+            v := in + amount * old
+            delay_write(line, iter, v, note)
+            return old - amount * v
+    }
+    return 0
+}
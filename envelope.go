@@ -0,0 +1,59 @@
+package d4
+
+import "math"
+
+/* Slots an envelope keeps between samples: its level, whether the gate was open,
+   and its level and the iteration when the gate last opened or closed */
+const ENVELOPE_STATE = 4
+
+const E_LEVEL = 0
+const E_GATE = 1
+const E_EDGE_LEVEL = 2
+const E_EDGE_ITER = 3
+
+/* The level of the envelope with its state at addr. Times are in the same units as
+   age (so use S). Attack starts from wherever the level was when the gate opened, and
+   release goes down to 0 from wherever it was when the gate closed */
+
+func (m *OpcodeMachine) envelope( iter int64, addr float64, block int,
+                                  age float64, gate float64, attack float64, decay float64, sustain float64, release float64 ) float64 {
+
+    last := m.state(iter, addr, E_LEVEL, block)
+    was_open := m.state(iter, addr, E_GATE, block) != 0
+    edge_level := m.state(iter, addr, E_EDGE_LEVEL, block)
+    edge_iter := m.state(iter, addr, E_EDGE_ITER, block)
+
+    open := gate != 0
+    if open != was_open {
+        edge_level, edge_iter = last, float64(iter)
+    }
+
+    level := 0.0
+    if open {
+        switch {
+            case age < attack:
+                level = edge_level + (1 - edge_level) * age / attack
+            case age - attack < decay:
+                level = 1 - (1 - sustain) * (age - attack) / decay
+            default:
+                level = sustain
+        }
+    } else {
+        elapsed := (float64(iter) - edge_iter) * m.step * 2 * math.Pi
+        if elapsed < release {
+            level = edge_level * (1 - elapsed / release)
+        }
+    }
+
+    gate_state := 0.0
+    if open {
+        gate_state = 1
+    }
+
+    m.keep_state(iter, addr, E_LEVEL, block, level)
+    m.keep_state(iter, addr, E_GATE, block, gate_state)
+    m.keep_state(iter, addr, E_EDGE_LEVEL, block, edge_level)
+    m.keep_state(iter, addr, E_EDGE_ITER, block, edge_iter)
+
+    return level
+}
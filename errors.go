@@ -0,0 +1,43 @@
+package d4
+
+import "fmt"
+
+const PHASE_SCAN = "Scan"
+const PHASE_PROGRAM = "Program"
+const PHASE_COMPILE = "Compile"
+const PHASE_OPTIMIZE = "Optimize"
+const PHASE_RUNTIME = "Runtime"
+
+/* Something wrong with a program, found while reading, compiling or running it */
+type Error struct {
+    Phase string // one of the PHASE_ constants
+    Pos Pos      // where the offending word is in the source, if known
+    Word string  // the offending word, if there is one
+    Msg string
+    ptr int      // for runtime errors, where in the code it happened
+}
+
+func (e *Error) Error() string {
+    if e.Pos.Line == 0 {
+        return fmt.Sprintf("%s error: %s", e.Phase, e.Msg)
+    }
+    return fmt.Sprintf("%s: %s error: %s", e.Pos, e.Phase, e.Msg)
+}
+
+func error_at(phase string, pos Pos, word string, format string, a ...interface{}) *Error {
+    return &Error{phase, pos, word, fmt.Sprintf(format, a...), -1}
+}
+
+/* Runtime errors only know where they are in the code. Look up their position with locate */
+func runtime_error(ptr int, word string, format string, a ...interface{}) *Error {
+    return &Error{PHASE_RUNTIME, Pos{}, word, fmt.Sprintf(format, a...), ptr}
+}
+
+/* Fill in the source position of a runtime error from the table of positions of the code it ran */
+func locate(err error, code_pos []Pos) error {
+    e, ok := err.(*Error)
+    if ok && e.ptr >= 0 && e.ptr < len(code_pos) {
+        e.Pos = code_pos[e.ptr]
+    }
+    return err
+}
@@ -0,0 +1,79 @@
+package d4
+
+import "math"
+
+/* Slots a biquad keeps between samples (transposed direct form II) */
+const FILTER_STATE = 2
+
+const F_S1 = 0
+const F_S2 = 1
+
+/* Cutoffs are kept below Nyquist (as a fraction of the sample rate), where the filters stop making sense */
+const MAX_CUTOFF = 0.49
+
+/* Coefficients for the filter word w at cutoff Hz, after the Audio EQ Cookbook.
+   gain is in dB and only matters to PEAK and the shelves */
+
+func biquad_coefficients( w int, cutoff float64, q float64, gain float64, sample_rate float64 ) (b0, b1, b2, a1, a2 float64) {
+
+    cutoff = math.Max(0, math.Min(cutoff, sample_rate * MAX_CUTOFF))
+    w0 := 2 * math.Pi * cutoff / sample_rate
+    cos_w0, sin_w0 := math.Cos(w0), math.Sin(w0)
+    alpha := sin_w0 / (2 * q)
+    a := math.Pow(10, gain / 40)
+
+    var a0 float64
+    switch w {
+        case W_LPF:
+            b0, b1, b2 = (1 - cos_w0) / 2, 1 - cos_w0, (1 - cos_w0) / 2
+            a0, a1, a2 = 1 + alpha, -2 * cos_w0, 1 - alpha
+        case W_HPF:
+            b0, b1, b2 = (1 + cos_w0) / 2, -(1 + cos_w0), (1 + cos_w0) / 2
+            a0, a1, a2 = 1 + alpha, -2 * cos_w0, 1 - alpha
+        case W_BPF:
+            b0, b1, b2 = alpha, 0, -alpha
+            a0, a1, a2 = 1 + alpha, -2 * cos_w0, 1 - alpha
+        case W_NOTCH:
+            b0, b1, b2 = 1, -2 * cos_w0, 1
+            a0, a1, a2 = 1 + alpha, -2 * cos_w0, 1 - alpha
+        case W_PEAK:
+            b0, b1, b2 = 1 + alpha * a, -2 * cos_w0, 1 - alpha * a
+            a0, a1, a2 = 1 + alpha / a, -2 * cos_w0, 1 - alpha / a
+        case W_LOSHELF:
+            root := 2 * math.Sqrt(a) * alpha
+            b0 = a * ((a + 1) - (a - 1) * cos_w0 + root)
+            b1 = 2 * a * ((a - 1) - (a + 1) * cos_w0)
+            b2 = a * ((a + 1) - (a - 1) * cos_w0 - root)
+            a0 = (a + 1) + (a - 1) * cos_w0 + root
+            a1 = -2 * ((a - 1) + (a + 1) * cos_w0)
+            a2 = (a + 1) + (a - 1) * cos_w0 - root
+        case W_HISHELF:
+            root := 2 * math.Sqrt(a) * alpha
+            b0 = a * ((a + 1) + (a - 1) * cos_w0 + root)
+            b1 = -2 * a * ((a - 1) + (a + 1) * cos_w0)
+            b2 = a * ((a + 1) + (a - 1) * cos_w0 - root)
+            a0 = (a + 1) - (a - 1) * cos_w0 + root
+            a1 = 2 * ((a - 1) - (a + 1) * cos_w0)
+            a2 = (a + 1) - (a - 1) * cos_w0 - root
+    }
+
+    return b0 / a0, b1 / a0, b2 / a0, a1 / a0, a2 / a0
+}
+
+/* One sample of the biquad with its state at addr. Coefficients are worked out every
+   sample, so cutoff, Q and gain can all be modulated */
+
+func (m *OpcodeMachine) biquad( iter int64, addr float64, block int,
+                                w int, in float64, cutoff float64, q float64, gain float64 ) float64 {
+
+    b0, b1, b2, a1, a2 := biquad_coefficients(w, cutoff, q, gain, m.config.SampleRate)
+
+    s1 := m.state(iter, addr, F_S1, block)
+    s2 := m.state(iter, addr, F_S2, block)
+
+    out := b0 * in + s1
+    m.keep_state(iter, addr, F_S1, block, b1 * in - a1 * out + s2)
+    m.keep_state(iter, addr, F_S2, block, b2 * in - a2 * out)
+
+    return out
+}
@@ -0,0 +1,42 @@
+package d4
+
+import "math"
+
+/* Slots an operator keeps between samples: its phase, and its last two outputs for feedback */
+const OPERATOR_STATE = 3
+
+const O_PHASE = 0
+const O_OUT1 = 1
+const O_OUT2 = 2
+
+/* A PHASE word keeps the angle it has got to */
+const PHASE_STATE = 1
+
+/* Move the phase kept in slot k on by one sample at freq (as from HZ), and return
+   where it was. Keeping the phase, rather than working it out from T, means
+   the frequency can change without the wave jumping */
+
+func (m *OpcodeMachine) accumulate( iter int64, addr float64, k int, block int, freq float64 ) float64 {
+    phase := m.state(iter, addr, k, block)
+    next := math.Mod(phase + freq * m.step * 2*math.Pi, 2*math.Pi)
+    if next < 0 {
+        next += 2*math.Pi
+    }
+    m.keep_state(iter, addr, k, block, next)
+    return phase
+}
+
+/* One sample of a sine operator, with its phase pushed along by mod, and by its own
+   output times feedback. Feedback uses the mean of the last two outputs, which
+   keeps high feedback from buzzing */
+
+func (m *OpcodeMachine) operator( iter int64, addr float64, block int, freq float64, mod float64, feedback float64 ) float64 {
+    phase := m.accumulate(iter, addr, O_PHASE, block, freq)
+    last := (m.state(iter, addr, O_OUT1, block) + m.state(iter, addr, O_OUT2, block)) / 2
+
+    out := math.Sin(phase + mod + feedback * last)
+
+    m.keep_state(iter, addr, O_OUT2, block, m.state(iter, addr, O_OUT1, block))
+    m.keep_state(iter, addr, O_OUT1, block, out)
+    return out
+}
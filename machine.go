@@ -4,21 +4,44 @@ import "io"
 
 
 type MachineData struct {
+    config Config
     iter int64
-    sample_rate float64
     save_len int
     clip float64
     controls map[string]float64
-    imports func(string) (string, error)
-    workers int
+    tempo float64      // beats per minute
+    tempo_iter int64   // the iteration the tempo was last changed at
+    tempo_beat float64 // and how many beats had gone by then
+    midi *Sequence     // for NOTE, VELOCITY, GATE and AGE
+    live *Sequence     // notes from NoteOn and NoteOff, as a single track
+}
+
+/* The configuration the machine was made with */
+
+func (d MachineData) Config() Config {
+    return d.config
+}
+
+const ALL_CHANNELS = -1
+
+/* A value sent to the output. Channel is ALL_CHANNELS unless it was sent
+   with CH, LEFT, RIGHT or PAN */
+type Output struct {
+    Channel int
+    Value float64
 }
 
 type Machine interface {
     Init(Machine) error
     Program(io.Reader) error
+    Reprogram(io.Reader, int) error
     Run() ([]float64, error)
-    RunCode([]float64, int64) ([]float64, []float64, error)
     Fill32([]float32) error
+    FillInterleaved32([]float32, int) error
     GetData() MachineData
     Set(string,float64) error
+    LoadMIDI(io.Reader) error
+    NoteOn(int, float64) error
+    NoteOff(int) error
+    Controls() []ControlInfo
 }
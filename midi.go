@@ -0,0 +1,305 @@
+package d4
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "sort"
+)
+
+/* The track number for notes from NoteOn and NoteOff */
+const LIVE_TRACK = -1
+
+/* A note from a MIDI file, with times in seconds from the start */
+type MIDINote struct {
+    Start float64
+    End float64
+    Key int      // 69 is A4
+    Velocity int // 1 to 127
+}
+
+/* The notes of a Standard MIDI File, track by track. Each track's notes are also
+   shared out between voices, so that no voice has two notes at once */
+type Sequence struct {
+    Tracks [][]MIDINote
+    voices [][][]MIDINote
+}
+
+/* A note on or off, before we know when it is in seconds */
+type midi_event struct {
+    tick int64
+    on bool
+    channel byte
+    key int
+    velocity int
+}
+
+type tempo_change struct {
+    tick int64
+    usec float64 // per quarter note
+}
+
+func ReadMIDI(in io.Reader) (*Sequence, error) {
+    data, err := io.ReadAll(in)
+    if err != nil {
+        return nil, err
+    }
+
+    r := bytes.NewReader(data)
+
+    kind, header, err := read_chunk(r)
+    if err != nil || kind != "MThd" || len(header) < 6 {
+        return nil, fmt.Errorf("MIDI error: not a Standard MIDI File")
+    }
+
+    ntracks := int(binary.BigEndian.Uint16(header[2:4]))
+    division := binary.BigEndian.Uint16(header[4:6])
+
+    tracks := [][]midi_event{}
+    ends := []int64{}
+    tempos := []tempo_change{ tempo_change{0, 500000} }
+
+    for len(tracks) < ntracks {
+        kind, chunk, err := read_chunk(r)
+        if err != nil {
+            return nil, fmt.Errorf("MIDI error: track %d: %v", len(tracks), err)
+        }
+        if kind != "MTrk" {
+            continue // unknown chunks are allowed, and skipped
+        }
+        events, end, track_tempos, err := read_track(chunk)
+        if err != nil {
+            return nil, fmt.Errorf("MIDI error: track %d: %v", len(tracks), err)
+        }
+        tracks = append(tracks, events)
+        ends = append(ends, end)
+        tempos = append(tempos, track_tempos...)
+    }
+
+    sort.SliceStable(tempos, func(i, j int) bool { return tempos[i].tick < tempos[j].tick })
+
+    seconds := func(tick int64) float64 {
+        if division & 0x8000 != 0 {
+            // SMPTE: frames per second and ticks per frame
+            fps := float64(-int8(division >> 8))
+            if fps == 29 {
+                fps = 29.97
+            }
+            return float64(tick) / (fps * float64(division & 0xff))
+        }
+        s := 0.0
+        for i, t := range tempos {
+            if t.tick >= tick {
+                break
+            }
+            until := tick
+            if i+1 < len(tempos) && tempos[i+1].tick < tick {
+                until = tempos[i+1].tick
+            }
+            s += float64(until - t.tick) * t.usec / 1e6 / float64(division)
+        }
+        return s
+    }
+
+    seq := &Sequence{}
+    for k, events := range tracks {
+        notes := []MIDINote{}
+        held := map[[2]int][]int{} // notes still on for each channel and key, oldest first
+        for _, e := range events {
+            at := [2]int{int(e.channel), e.key}
+            if e.on {
+                held[at] = append(held[at], len(notes))
+                notes = append(notes, MIDINote{seconds(e.tick), -1, e.key, e.velocity})
+            } else if len(held[at]) > 0 {
+                notes[held[at][0]].End = seconds(e.tick)
+                held[at] = held[at][1:]
+            }
+        }
+        for i := range notes {
+            if notes[i].End < 0 {
+                // never let go, so it lasts until the end of the track
+                notes[i].End = seconds(ends[k])
+            }
+        }
+        seq.Tracks = append(seq.Tracks, notes)
+    }
+
+    seq.share(0)
+    return seq, nil
+}
+
+/* Share each track's notes between at most max voices (or as many as it takes, if max is 0) */
+
+func (s *Sequence) share(max int) {
+    s.voices = [][][]MIDINote{}
+    for _, notes := range s.Tracks {
+        s.voices = append(s.voices, share_voices(notes, max))
+    }
+}
+
+func read_chunk(r *bytes.Reader) (string, []byte, error) {
+    var header [8]byte
+    _, err := io.ReadFull(r, header[:])
+    if err != nil {
+        return "", nil, err
+    }
+    length := binary.BigEndian.Uint32(header[4:])
+    if int64(length) > int64(r.Len()) {
+        return "", nil, fmt.Errorf("%s chunk of %d bytes, but only %d left", header[:4], length, r.Len())
+    }
+    chunk := make([]byte, length)
+    _, err = io.ReadFull(r, chunk)
+    return string(header[:4]), chunk, err
+}
+
+func read_varlen(data []byte, i int) (int64, int, error) {
+    var n int64
+    for k := 0; k < 4; k++ {
+        if i >= len(data) {
+            return 0, i, fmt.Errorf("ran out of data")
+        }
+        b := data[i]
+        i += 1
+        n = n << 7 | int64(b & 0x7f)
+        if b & 0x80 == 0 {
+            return n, i, nil
+        }
+    }
+    return 0, i, fmt.Errorf("bad variable length number")
+}
+
+/* The note events in a track, when it ends, and any tempo changes in it */
+
+func read_track(data []byte) ([]midi_event, int64, []tempo_change, error) {
+    events := []midi_event{}
+    tempos := []tempo_change{}
+
+    var tick int64
+    var status byte
+    i := 0
+
+    for i < len(data) {
+        delta, next, err := read_varlen(data, i)
+        if err != nil {
+            return events, tick, tempos, err
+        }
+        tick += delta
+        i = next
+
+        if i >= len(data) {
+            return events, tick, tempos, fmt.Errorf("ran out of data")
+        }
+        if data[i] & 0x80 != 0 {
+            status = data[i]
+            i += 1
+        } else if status == 0 {
+            return events, tick, tempos, fmt.Errorf("data byte with no status at tick %d", tick)
+        }
+
+        switch {
+            case status == 0xff:
+                if i >= len(data) {
+                    return events, tick, tempos, fmt.Errorf("ran out of data")
+                }
+                kind := data[i]
+                length, next, err := read_varlen(data, i+1)
+                if err != nil || next + int(length) > len(data) {
+                    return events, tick, tempos, fmt.Errorf("bad meta event at tick %d", tick)
+                }
+                meta := data[next:next+int(length)]
+                i = next + int(length)
+                if kind == 0x51 && len(meta) == 3 {
+                    usec := int(meta[0]) << 16 | int(meta[1]) << 8 | int(meta[2])
+                    tempos = append(tempos, tempo_change{tick, float64(usec)})
+                }
+                if kind == 0x2f {
+                    return events, tick, tempos, nil
+                }
+                status = 0 // running status doesn't carry over meta events
+
+            case status == 0xf0 || status == 0xf7:
+                length, next, err := read_varlen(data, i)
+                if err != nil || next + int(length) > len(data) {
+                    return events, tick, tempos, fmt.Errorf("bad sysex at tick %d", tick)
+                }
+                i = next + int(length)
+                status = 0
+
+            default:
+                size := 2
+                if status & 0xf0 == 0xc0 || status & 0xf0 == 0xd0 {
+                    size = 1
+                }
+                if i + size > len(data) {
+                    return events, tick, tempos, fmt.Errorf("ran out of data")
+                }
+                switch status & 0xf0 {
+                    case 0x90:
+                        events = append(events, midi_event{tick, data[i+1] > 0, status & 0x0f, int(data[i]), int(data[i+1])})
+                    case 0x80:
+                        events = append(events, midi_event{tick, false, status & 0x0f, int(data[i]), int(data[i+1])})
+                }
+                i += size
+        }
+    }
+
+    return events, tick, tempos, nil
+}
+
+/* Give each note the lowest numbered voice that's free when it starts. If there
+   are already max voices playing, the one playing the oldest note stops */
+
+func share_voices(notes []MIDINote, max int) [][]MIDINote {
+    voices := [][]MIDINote{}
+    for _, n := range notes {
+        v := free_voice(voices, n.Start, max)
+        if v == len(voices) {
+            voices = append(voices, []MIDINote{})
+        }
+        voices[v] = append(voices[v], n)
+    }
+    return voices
+}
+
+func free_voice(voices [][]MIDINote, t float64, max int) int {
+    oldest := -1
+    for v, notes := range voices {
+        last := &notes[len(notes)-1]
+        if last.End <= t {
+            return v
+        }
+        if oldest < 0 || last.Start < voices[oldest][len(voices[oldest])-1].Start {
+            oldest = v
+        }
+    }
+    if max > 0 && len(voices) >= max {
+        voices[oldest][len(voices[oldest])-1].End = t
+        return oldest
+    }
+    return len(voices)
+}
+
+/* How many voices a track has */
+
+func (s *Sequence) voice_count(track int) int {
+    if s == nil || track < 0 || track >= len(s.voices) {
+        return 0
+    }
+    return len(s.voices[track])
+}
+
+/* The last note to start on a voice by time t, and whether it's still held.
+   A missing sequence, track or voice just never plays anything */
+
+func (s *Sequence) playing(track int, voice int, t float64) (MIDINote, bool) {
+    if s == nil || track < 0 || track >= len(s.voices) || voice < 0 || voice >= len(s.voices[track]) {
+        return MIDINote{}, false
+    }
+    notes := s.voices[track][voice]
+    i := sort.Search(len(notes), func(i int) bool { return notes[i].Start > t })
+    if i == 0 {
+        return MIDINote{}, false
+    }
+    return notes[i-1], t < notes[i-1].End
+}
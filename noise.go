@@ -0,0 +1,64 @@
+package d4
+
+import "math"
+
+/* Noise is a hash of the seed, the iteration and where in the code it was asked for,
+   so it comes out the same however many workers there are, and two NOISEs differ */
+
+const GOLDEN = 0x9e3779b97f4a7c15
+
+/* Rows of white noise added up for PINK, each changing half as often as the last */
+const PINK_ROWS = 16
+
+/* A brown noise word keeps its last value */
+const BROWN_STATE = 1
+
+/* The splitmix64 finaliser */
+
+func mix( x uint64 ) uint64 {
+    x ^= x >> 30
+    x *= 0xbf58476d1ce4e5b9
+    x ^= x >> 27
+    x *= 0x94d049bb133111eb
+    x ^= x >> 31
+    return x
+}
+
+/* Where a noise word is: the instruction, and which voice is running it */
+
+func noise_site( code_ptr int, block int ) uint64 {
+    return mix(uint64(code_ptr) << 32 | uint64(block))
+}
+
+/* White noise from -1 to 1, for the nth sample (or step) at site */
+
+func white_noise( seed int64, n int64, site uint64 ) float64 {
+    x := mix(uint64(seed) + GOLDEN * uint64(n))
+    x = mix(x ^ site)
+    return float64(x >> 11) / (1 << 52) - 1
+}
+
+/* Voss-McCartney pink noise, roughly from -1 to 1 */
+
+func pink_noise( seed int64, iter int64, site uint64 ) float64 {
+    sum := white_noise(seed, iter, site)
+    for row := 1; row <= PINK_ROWS; row++ {
+        sum += white_noise(seed, iter >> uint(row), site + GOLDEN * uint64(row))
+    }
+    return sum * 2 / (PINK_ROWS + 1)
+}
+
+/* Brown noise, roughly from -1 to 1, by leaky integration of white noise */
+
+func (m *OpcodeMachine) brown_noise( iter int64, addr float64, block int, white float64 ) float64 {
+    last := m.state(iter, addr, 0, block)
+    next := (last + 0.02 * white) / 1.02
+    m.keep_state(iter, addr, 0, block, next)
+    return next * 3.5
+}
+
+/* A new value from -1 to 1 every cycle of angle, held until the next */
+
+func sample_hold( seed int64, angle float64, site uint64 ) float64 {
+    return white_noise(seed, int64(math.Floor(angle / (2*math.Pi))), site)
+}
@@ -3,11 +3,11 @@ package d4
 import (
     "strings"
     "math"
-    "math/rand"
     "fmt"
     "strconv"
-    "bufio"
+    "sort"
     "io"
+    "unicode/utf8"
 )
 
 type Job struct {
@@ -17,42 +17,100 @@ type Job struct {
 
 type JobResult struct {
     id int
-    value []float64
+    value []Output
     err error
 }
 
+/* A VOICES site working through the voices of a track */
+type VoiceState struct {
+    site int
+    track int
+    voice int
+    sum float64
+}
+
+type LoopState struct {
+    index float64
+    limit float64
+}
+
+/* One step of a compiled program. Where control words go next is worked out by link,
+   so skipping a branch doesn't mean stepping over every word in it */
+type Instruction struct {
+    op int
+    value float64  // for W_NUMBER
+    jump int       // the next instruction when skipping past the block (IF FROM DO)
+                   // or leaving it (ELSE , ) or going round again (LOOP)
+    branches []int // where each branch of an IF or FROM starts
+}
+
 const M_NORMAL = 0
 const M_COLON = 1
 const M_DEF = 2
 const M_CONSTANT = 3
 const M_COMMENT = 4
 const M_IF_FALSE = 5
-const M_CHOOSE_FALSE = 6
 const M_LITERAL = 7
 const M_IMPORT = 8
 const M_KEEP = 9
+const M_TUNING = 10
+const M_SAMPLE = 11
+const M_CONTROL_INFO = 12
+
+/* Address of the first save name. Numbers below this can't be used with @ ! OLD or DELTA */
+const SAVE_BASE = 1000
+
+/* Most times LOOP may jump back in a single run, to keep the sample rate up */
+const LOOP_LIMIT = 1024
 
 type OpcodeMachine struct {
     MachineData
     step float64
-    code []float64
-    words map[string][]string
+    tuning Tuning     // from the program's TUNING, or nil to use the config's
+    semitone float64
+    code []Instruction
+    code_pos []Pos
+    words map[string][]Token
     save_addr int
-    saves []map[float64]float64
+    saves []float64     // save_len rows of save_slots values, one row per iteration
+    saved_at []int64    // the iteration each value in saves was stored in
+    save_slots int
+    states []float64    // state_slots values for one sample then state_slots for the next, taking turns
+    state_at []int64    // the iteration each value in states was kept in
+    state_slots int
+    state_addr int      // the next state slot for a word to keep its state in
     control_keys map[string]float64
-    opcode_info map[float64]Word
+    control_info map[string]ControlInfo
+    control_order []string       // the controls in the order they were declared
+    save_keys map[string]float64 // every KEEP and CONSTANT, for carrying history over to a new program
+    save_owner map[string]string // the word each KEEP and CONSTANT was in
+    voice_slots [][]int          // for each voice of each VOICES site, the slot each save slot moves to
+    voice_states [][]int         // and the slot each state slot moves to
+    voice_sites int
+    state_keys map[string]int    // for each word keeping state, where it is in the program, naming its slots
+    voice_keys map[string]int    // and for each VOICES site, naming the site, so a new program can take them over
+    stateful bool                // whether any word needs the last sample's state or changes the machine (CLIP), so samples must be worked out in order
+    delay_slots []int            // the state slot of each delay word, before voices move it
+    delays []*DelayLine          // for each state slot belonging to a delay word, its buffer
+    tables []*Table              // loaded by SAMPLE, each named by a word giving its index
+    table_ids map[string]int     // the index of each SAMPLE name, so loading it again replaces it
+    fade_from *OpcodeMachine     // the previous program, while crossfading to this one
+    fade_end int64               // iteration when the crossfade is over
+    fade_len int64
 }
 
-func NewOpcodeMachine( sample_rate float64, save_s float64, clip float64, imports func(string) (string, error), workers int ) *OpcodeMachine {
+func NewOpcodeMachine( config Config ) *OpcodeMachine {
+
+    config = config.with_defaults()
 
-    save_len := int(save_s * sample_rate)
+    save_len := int(config.SaveSeconds * config.SampleRate)
 
-    if (save_len < 2*workers) {
-        save_len = 2*workers // must have this many samples stored to be able to figure out delta
+    if (save_len < 2*config.Workers) {
+        save_len = 2*config.Workers // must have this many samples stored to be able to figure out delta
     }
 
-    return &OpcodeMachine{MachineData{0, sample_rate, save_len, clip, nil, imports, workers},
-                          1/(LOOP*sample_rate), nil, nil, 1000, nil, nil, nil}
+    return &OpcodeMachine{MachineData{config, 0, save_len, config.Clip, nil, config.Tempo, 0, 0, nil, &Sequence{nil, [][][]MIDINote{ [][]MIDINote{} }}},
+                          1/(config.Loop*config.SampleRate), nil, semitone(config.Tuning), nil, nil, nil, SAVE_BASE, nil, nil, 0, nil, nil, 0, 0, nil, nil, nil, nil, nil, nil, nil, 0, nil, nil, false, nil, nil, nil, nil, nil, 0, 0}
 }
 
 func (m *OpcodeMachine) GetData() MachineData {
@@ -61,60 +119,518 @@ func (m *OpcodeMachine) GetData() MachineData {
 
 func (m *OpcodeMachine) Init(clone_from Machine) error {
 
-    m.opcode_info = map[float64]Word{
-        W_NUMBER: Word{ "n", W_NUMBER, false, 0 }, // this opcode is created, not supplied
-    }
-
     if clone_from != nil {
         m.MachineData = clone_from.GetData()
-        m.step = 1/(LOOP*m.sample_rate)
+        m.step = 1/(m.config.Loop*m.config.SampleRate)
     } else {
         m.controls = map[string]float64{}
     }
 
     m.control_keys = map[string]float64{}
-
-    m.saves = make([]map[float64]float64, m.save_len + 1)
+    m.control_info = map[string]ControlInfo{}
+    m.control_order = nil
+    m.save_keys = map[string]float64{}
+    m.save_owner = map[string]string{}
+
+    m.tuning = nil
+    m.semitone = semitone(m.config.Tuning)
+
+    m.saves = nil
+    m.saved_at = nil
+    m.save_slots = 0
+    m.states = nil
+    m.state_at = nil
+    m.state_slots = 0
+    m.state_addr = 0
+    m.delays = nil
+    m.tables = nil
+    m.table_ids = map[string]int{}
 
     return nil
 }
 
+/* Set a control to value. TEMPO isn't a control but the machine's tempo, which
+   changes from the current iteration on without making BEAT jump */
+
 func (m *OpcodeMachine) Set( control string, value float64 ) error {
-    m.controls[strings.ToUpper(control)] = value
+    control = strings.ToUpper(control)
+    if control == "TEMPO" {
+        if value <= 0 {
+            return fmt.Errorf("Set error: tempo must be positive, not %v", value)
+        }
+        m.tempo_beat, m.tempo_iter, m.tempo = m.beat(m.iter), m.iter, value
+        return nil
+    }
+    info, ok := m.control_info[control]
+    if !ok {
+        return fmt.Errorf("Set error: no control called %s", control)
+    }
+    if math.IsNaN(value) || value < info.Min || value > info.Max {
+        return fmt.Errorf("Set error: %s must be from %v to %v, not %v", control, info.Min, info.Max, value)
+    }
+    m.controls[control] = value
     return nil
 }
 
+/* Play the notes of a Standard MIDI File with NOTE, VELOCITY, GATE and AGE.
+   The file's own tempo is used, not the machine's */
+
+func (m *OpcodeMachine) LoadMIDI( in io.Reader ) error {
+    seq, err := ReadMIDI(in)
+    if err != nil {
+        return err
+    }
+    seq.share(m.config.Polyphony)
+    m.midi = seq
+    return nil
+}
+
+/* Start playing key (69 is A4) on the LIVE track, with velocity from 0 to 1.
+   If Polyphony notes are already playing, the oldest one stops */
+
+func (m *OpcodeMachine) NoteOn( key int, velocity float64 ) error {
+    if key < 0 || key > 127 || velocity <= 0 || velocity > 1 {
+        return fmt.Errorf("NoteOn error: key %d velocity %v out of range", key, velocity)
+    }
+    now := float64(m.iter) / m.config.SampleRate
+    voices := m.live.voices[0]
+    v := free_voice(voices, now, m.config.Polyphony)
+    if v == len(voices) {
+        voices = append(voices, []MIDINote{})
+    }
+    voices[v] = append(voices[v], MIDINote{now, math.Inf(1), key, int(math.Max(1, math.Round(velocity * 127)))})
+    m.live.voices[0] = voices
+    return nil
+}
+
+/* Let go of key on the LIVE track */
+
+func (m *OpcodeMachine) NoteOff( key int ) error {
+    if key < 0 || key > 127 {
+        return fmt.Errorf("NoteOff error: key %d out of range", key)
+    }
+    now := float64(m.iter) / m.config.SampleRate
+    for _, notes := range m.live.voices[0] {
+        last := &notes[len(notes)-1]
+        if last.Key == key && last.End > now {
+            last.End = now
+        }
+    }
+    return nil
+}
+
+/* The last note to start on a voice of a MIDI track (or LIVE_TRACK) by time t, and whether it's still held */
+
+func (m *OpcodeMachine) playing( track int, voice int, t float64 ) (MIDINote, bool) {
+    if track == LIVE_TRACK {
+        return m.live.playing(0, voice, t)
+    }
+    return m.midi.playing(track, voice, t)
+}
+
+/* The first voice after `after` which has played something by time t, or -1 */
+
+func (m *OpcodeMachine) next_voice( track int, after int, t float64 ) int {
+    for v := after + 1; v < m.config.Polyphony; v++ {
+        note, _ := m.playing(track, v, t)
+        if note.Velocity > 0 {
+            return v
+        }
+    }
+    return -1
+}
+
+/* Push what a VOICES patch is given: ( -- freq velocity gate age ) */
+
+func (m *OpcodeMachine) voice_args( stack []float64, track int, voice int, t float64 ) []float64 {
+    note, held := m.playing(track, voice, t)
+    gate := 0.0
+    if held {
+        gate = 1
+    }
+    return append(stack, pitch(m.tuned(), note.Key - 69) * m.config.Loop, float64(note.Velocity) / 127, gate,
+                  (t - note.Start) * 2 * math.Pi / m.config.Loop)
+}
+
+/* Turn tracing every opcode to the config's Logger on or off */
+
+func (m *OpcodeMachine) SetDebug( on bool ) {
+    m.config.Debug = on
+}
+
+/* How many beats have gone by at iter */
+
+func (m *OpcodeMachine) beat( iter int64 ) float64 {
+    return m.tempo_beat + float64(iter - m.tempo_iter) * m.tempo / (60 * m.config.SampleRate)
+}
+
 func (m *OpcodeMachine) Program( in io.Reader ) error {
 
-    words := map[string][]string{ "": []string{},
-                                  "?": []string{ "@", "." },
-                                }
+    words := map[string][]Token{ "": []Token{},
+                                 "?": []Token{ Token{"@", Pos{}}, Token{".", Pos{}} },
+                               }
+
+    file := ""
+    named, ok := in.(interface{ Name() string })
+    if ok {
+        file = named.Name()
+    }
 
-    words, need_imports, err := m.read( in, words )
+    // samples from a previous program aren't needed any more
+    m.tables, m.table_ids = nil, map[string]int{}
+
+    words, need_imports, tuning, err := m.read( in, file, words )
 
     m.words = words
+    m.tuning = tuning
+
+    if err != nil {
+        return err
+    }
+
+    err = m.import_packages(need_imports, []string{}, map[string]bool{})
+
+    if err != nil {
+        return err
+    }
+
+    m.drop_stored_controls()
+
+    // We now have a set of word definitions (counting '' for everything outside a word definition)
+    // which we can translate into opcodes
+
+    m.semitone = semitone(m.tuned())
+    m.voice_sites, m.voice_slots, m.voice_states, m.stateful, m.delay_slots = 0, nil, nil, m.smoothed(), nil
+    m.state_keys, m.voice_keys = map[string]int{}, map[string]int{}
+
+    var breadcrumb []string = []string{}
+    var code = []Instruction{}
+    var code_pos = []Pos{}
+
+    code, code_pos, err = m.compile(code, code_pos, Token{"", Pos{file, 0, 0}}, breadcrumb)
+
+    if err != nil {
+        return err
+    }
+
+    code = append(code, Instruction{W_EOF, 0, 0, nil})
+    code_pos = append(code_pos, Pos{file, 0, 0})
+
+    m.code, m.code_pos, err = m.optimize(code, code_pos)
+
+    m.resize_saves()
+    m.resize_states()
+
+    return err
+}
+
+/* Make room in the saves for any save names added since they were last made,
+   keeping what's already there */
+
+func (m *OpcodeMachine) resize_saves() {
+    slots := m.save_addr - SAVE_BASE
+    if m.saves != nil && slots == m.save_slots {
+        return
+    }
+
+    saves := make([]float64, m.save_len * slots)
+    saved_at := make([]int64, m.save_len * slots)
+    for i := range saved_at {
+        saved_at[i] = -1
+    }
+
+    if m.save_slots > 0 {
+        for ptr := 0; ptr < m.save_len; ptr++ {
+            copy(saves[ptr*slots:], m.saves[ptr*m.save_slots:(ptr+1)*m.save_slots])
+            copy(saved_at[ptr*slots:], m.saved_at[ptr*m.save_slots:(ptr+1)*m.save_slots])
+        }
+    }
+
+    m.saves, m.saved_at, m.save_slots = saves, saved_at, slots
+}
+
+/* Make room in the states for any words compiled since they were last made,
+   keeping what's already there. Words only look one sample back at their state,
+   so unlike the saves there are just two rows */
+
+func (m *OpcodeMachine) resize_states() {
+    slots := m.state_addr
+    if m.states != nil && slots == m.state_slots {
+        return
+    }
+
+    states := make([]float64, 2 * slots)
+    state_at := make([]int64, 2 * slots)
+    for i := range state_at {
+        state_at[i] = -1
+    }
+
+    for row := 0; row < 2; row++ {
+        copy(states[row*slots:], m.states[row*m.state_slots:(row+1)*m.state_slots])
+        copy(state_at[row*slots:], m.state_at[row*m.state_slots:(row+1)*m.state_slots])
+    }
+
+    m.states, m.state_at, m.state_slots = states, state_at, slots
+    m.resize_delays()
+}
+
+/* Where in saves the value of addr for iteration iter goes, or -1 if addr isn't a save name.
+   Inside a voice (block > 0), the voice's own KEEPs are somewhere else */
+
+func (m *OpcodeMachine) save_index( iter int64, addr float64, block int ) int {
+    slot := int(addr) - SAVE_BASE
+    if addr != math.Floor(addr) || slot < 0 || slot >= m.save_slots {
+        return -1
+    }
+    if block > 0 && slot < len(m.voice_slots[block-1]) {
+        slot = m.voice_slots[block-1][slot]
+    }
+    return int(iter % int64(m.save_len)) * m.save_slots + slot
+}
+
+/* Forget everything saved at iteration iter, so that it can be run again */
+
+func (m *OpcodeMachine) forget_saves( iter int64 ) {
+    if iter < 0 {
+        return
+    }
+    row := int(iter % int64(m.save_len)) * m.save_slots
+    for i := row; i < row + m.save_slots; i++ {
+        if m.saved_at[i] == iter {
+            m.saved_at[i] = -1
+        }
+    }
+}
+
+/* The value saved under addr `back` iterations before iter, or 0 if there isn't one */
+
+func (m *OpcodeMachine) saved( iter int64, back int, addr float64, block int ) float64 {
+    then := iter - int64(back)
+    if back < 0 || back >= m.save_len || then < 0 {
+        return 0
+    }
+
+    i := m.save_index(then, addr, block)
+    if m.saved_at[i] != then {
+        return 0
+    }
+    return m.saves[i]
+}
+
+/* Replace the program while running, without losing the history of KEEPs and
+   CONSTANTs which are in both programs, or the state of words (filters, envelopes...)
+   in the same place in both. For the next `crossfade` samples both programs run,
+   with the old one fading out. If the new program doesn't compile, the old one is
+   left running, and its controls are left as they were */
+
+func (m *OpcodeMachine) Reprogram( in io.Reader, crossfade int ) error {
+
+    n := NewOpcodeMachine(Config{})
+    n.Init(m)
+
+    // defaults go into a copy of the controls until the program has compiled
+    n.controls = map[string]float64{}
+    for k, v := range m.controls {
+        n.controls[k] = v
+    }
 
+    err := n.Program(in)
     if err != nil {
         return err
     }
 
-    for _, name := range need_imports {
+    for k, v := range n.controls {
+        m.controls[k] = v
+    }
+    n.controls = m.controls
+
+    n.take_over(m)
+
+    old := *m
+    old.fade_from = nil
+
+    *m = *n
+
+    if crossfade > 0 {
+        m.fade_from = &old
+        m.fade_end = m.iter + int64(crossfade)
+        m.fade_len = int64(crossfade)
+    }
+
+    return nil
+}
+
+/* Copy everything in m's saves and states which n has too, for every voice of
+   the VOICES sites they both have */
+
+func (n *OpcodeMachine) take_over( m *OpcodeMachine ) {
+    copy_save := func( from int, to int ) {
+        for ptr := 0; ptr < m.save_len; ptr++ {
+            n.saves[ptr*n.save_slots + to], n.saved_at[ptr*n.save_slots + to] = m.saves[ptr*m.save_slots + from], m.saved_at[ptr*m.save_slots + from]
+        }
+    }
+    copy_state := func( from int, to int ) {
+        for row := 0; row < 2; row++ {
+            n.states[row*n.state_slots + to], n.state_at[row*n.state_slots + to] = m.states[row*m.state_slots + from], m.state_at[row*m.state_slots + from]
+        }
+        if m.delays[from] != nil && n.delays[to] != nil {
+            copy(n.delays[to].values, m.delays[from].values)
+            copy(n.delays[to].written, m.delays[from].written)
+            copy(n.delays[to].notes, m.delays[from].notes)
+        }
+    }
+
+    // for each voice of each site in both, the slots a slot moves to in m and in n
+    type voice_pair struct{ from []int; to []int }
+    saves, states := []voice_pair{}, []voice_pair{}
+    for key, site := range n.voice_keys {
+        old_site, ok := m.voice_keys[key]
+        if !ok {
+            continue
+        }
+        for v := 0; v < n.config.Polyphony; v++ {
+            saves = append(saves, voice_pair{m.voice_slots[old_site*m.config.Polyphony + v], n.voice_slots[site*n.config.Polyphony + v]})
+            states = append(states, voice_pair{m.voice_states[old_site*m.config.Polyphony + v], n.voice_states[site*n.config.Polyphony + v]})
+        }
+    }
+
+    take := func( names map[string]int, old_names map[string]int, voices []voice_pair, copy_slot func(int, int) ) {
+        for name, to := range names {
+            from, ok := old_names[name]
+            if !ok {
+                continue
+            }
+            copy_slot(from, to)
+            for _, voice := range voices {
+                if from < len(voice.from) && to < len(voice.to) && voice.from[from] != from && voice.to[to] != to {
+                    copy_slot(voice.from[from], voice.to[to])
+                }
+            }
+        }
+    }
+
+    save_names, old_save_names := map[string]int{}, map[string]int{}
+    for name, addr := range n.save_keys {
+        save_names[name] = int(addr) - SAVE_BASE
+    }
+    for name, addr := range m.save_keys {
+        old_save_names[name] = int(addr) - SAVE_BASE
+    }
+
+    take(save_names, old_save_names, saves, copy_save)
+    take(n.state_keys, m.state_keys, states, copy_state)
+}
+
+/* Run some more code once, at iteration iter, without replacing the program.
+   Definitions are added to the program's words, replacing any with the same name,
+   so they can be used by later calls. This is for trying things out interactively,
+   so unlike Run, anything left on the stack is returned rather than being an error.
+   Whatever an earlier run saved at iter is forgotten, so the same iteration can be run again */
+
+func (m *OpcodeMachine) Eval( in io.Reader, iter int64 ) ([]Output, []float64, error) {
+
+    if iter < 0 {
+        return nil, nil, fmt.Errorf("Eval error: can't run at iteration %d", iter)
+    }
+
+    if m.words == nil {
+        m.words = map[string][]Token{ "?": []Token{ Token{"@", Pos{}}, Token{".", Pos{}} } }
+        m.state_keys, m.voice_keys = map[string]int{}, map[string]int{}
+    }
+
+    words, need_imports, tuning, err := m.read( in, "", nil )
+    if err != nil {
+        return nil, nil, err
+    }
+    if tuning != nil {
+        m.tuning = tuning
+    }
+
+    for w, defn := range words {
+        m.words[w] = defn
+    }
+    m.words[""] = words[""] // even if this time there was nothing outside definitions
+
+    err = m.import_packages(need_imports, []string{}, map[string]bool{})
+    if err != nil {
+        return nil, nil, err
+    }
+    m.drop_stored_controls()
+
+    m.semitone = semitone(m.tuned())
+    m.stateful = m.stateful || m.smoothed() // the program's voices and delays are left as they are
+
+    code, code_pos, err := m.compile([]Instruction{}, []Pos{}, Token{"", Pos{}}, []string{})
+    if err != nil {
+        return nil, nil, err
+    }
+
+    code, code_pos, err = m.optimize(append(code, Instruction{W_EOF, 0, 0, nil}), append(code_pos, Pos{}))
+    if err != nil {
+        return nil, nil, err
+    }
+
+    m.resize_saves()
+    m.resize_states()
+
+    m.forget_saves(iter)
+    m.start_saves(iter)
+    output, stack, err := m.RunCode(code, iter)
+
+    return output, stack, locate(err, code_pos)
+}
+
+/* The names of all the words defined by the program and its imports */
+
+func (m *OpcodeMachine) Words() []string {
+    names := []string{}
+    for w := range m.words {
+        if w != "" && w != "?" {
+            names = append(names, w)
+        }
+    }
+    sort.Strings(names)
+    return names
+}
+
+/* Pull in the definitions from each package, and then whatever those packages import.
+   chain is the list of packages which led to these imports, done is every package seen so far */
+
+func (m *OpcodeMachine) import_packages( names []Token, chain []string, done map[string]bool ) error {
 
-        code, err := m.imports(name)
+    for _, name := range names {
+
+        new_chain := append(append([]string{}, chain...), name.word)
+
+        for _, outer_name := range chain {
+            if outer_name == name.word {
+                return error_at(PHASE_PROGRAM, name.pos, name.word, "circular import %s", strings.Join(new_chain, " -> "))
+            }
+        }
+
+        if done[name.word] {
+            continue
+        }
+        done[name.word] = true
+
+        if m.config.Imports == nil {
+            return error_at(PHASE_PROGRAM, name.pos, name.word, "can't import %s: no packages configured", strings.Join(new_chain, " -> "))
+        }
+
+        code, err := m.config.Imports(name.word)
         if err != nil {
-            return err
+            return error_at(PHASE_PROGRAM, name.pos, name.word, "can't import %s: %v", strings.Join(new_chain, " -> "), err)
         }
 
-        in = strings.NewReader( code )
-        new_words, new_imports, err := m.read( in, nil )
+        in := strings.NewReader( code )
+        new_words, new_imports, tuning, err := m.read( in, name.word, nil )
 
         if err != nil {
             return err
         }
 
-        if len(new_imports)>0 {
-            return fmt.Errorf("Program error: import %s tried to import %s", name, new_imports)
-            // TODO: allow nested imports
+        if m.tuning == nil {
+            m.tuning = tuning
         }
 
         for w, defn := range new_words {
@@ -125,44 +641,43 @@ func (m *OpcodeMachine) Program( in io.Reader ) error {
                 // don't overwrite existing word
             }
         }
-    }
 
-    // We now have a set of word definitions (counting '' for everything outside a word definition)
-    // which we can translate into opcodes
-
-    var breadcrumb []string = []string{}
-    var code = []float64{}
-
-    code, err = m.compile(code, "", breadcrumb)
-
-    if err != nil {
-        return err
+        err = m.import_packages(new_imports, new_chain, done)
+        if err != nil {
+            return err
+        }
     }
 
-    code = append(code, W_EOF)
-
-    m.code, err = m.optimize(code)
-
-    return err
+    return nil
 }
 
-func (m *OpcodeMachine) read( in io.Reader, words map[string][]string ) (map[string][]string, []string, error) {
+func (m *OpcodeMachine) read( in io.Reader, file string, words map[string][]Token ) (map[string][]Token, []Token, Tuning, error) {
 
     if words == nil {
-        words = map[string][]string{}
+        words = map[string][]Token{}
     }
 
-    imports := []string{}
-
-    scanner := bufio.NewScanner(in)
+    imports := []Token{}
 
-    scanner.Split(ScanForthWords)
+    scanner := NewWordScanner(in, file)
 
     cur_word := ""
     mode := []int{M_NORMAL}
 
+    var tuning Tuning
+    edo := 0 // the number in TUNING n EDO
+    last_control := "" // the control declared by the last word, which { can describe
+    info_for := ""
+    var info []string
+    var info_end Pos // where the last word in { } ended
+
     for scanner.Scan() {
         w := strings.ToUpper(scanner.Text())
+        pos := scanner.Pos()
+        token := Token{w, pos}
+        after_control := last_control
+        last_control = ""
+
         switch mode[len(mode)-1] {
 
             case M_COLON:
@@ -173,11 +688,11 @@ func (m *OpcodeMachine) read( in io.Reader, words map[string][]string ) (map[str
 
                     _, exists := words[cur_word]
                     if exists {
-                        return words, imports, fmt.Errorf("Scan error: %s has already been defined", cur_word)
+                        return words, imports, nil, error_at(PHASE_SCAN, pos, w, "%s has already been defined", cur_word)
                     } else {
                         _, exists := WORDS[cur_word]
                         if exists {
-                            return words, imports, fmt.Errorf("Scan error: %s is a built-in word and cannot be redefined", cur_word)
+                            return words, imports, nil, error_at(PHASE_SCAN, pos, w, "%s is a built-in word and cannot be redefined", cur_word)
                         } else {
                             words[cur_word] = nil
                             mode[len(mode)-1] = M_DEF
@@ -187,30 +702,123 @@ func (m *OpcodeMachine) read( in io.Reader, words map[string][]string ) (map[str
 
             case M_CONSTANT:
 
-                words[w] = []string{strconv.Itoa(m.save_addr)} // everything is a string at this point
+                words[w] = []Token{Token{strconv.Itoa(m.save_addr), pos}} // everything is a string at this point
 
                 m.control_keys[w] = float64(m.save_addr)
+                m.save_keys[w] = float64(m.save_addr)
+                m.save_owner[w] = cur_word
+                _, described := m.control_info[w]
+                if !described {
+                    m.control_info[w] = ControlInfo{w, math.NaN(), math.Inf(-1), math.Inf(1), ""}
+                    m.control_order = append(m.control_order, w)
+                }
+                last_control = w
 
-                if DEBUG {
-                    fmt.Println("Assigning addr",m.save_addr,"to control",w," (current controls are ",m.controls,")")
+                if m.config.Debug {
+                    m.config.Logger.Println("Assigning addr",m.save_addr,"to control",w," (current controls are ",m.controls,")")
                 }
                 m.save_addr += 1
-                words[cur_word] = append(words[cur_word], w)
+                words[cur_word] = append(words[cur_word], token)
                 mode = mode[:len(mode)-1]
 
             case M_KEEP: // KEEP x === CONSTANT x !
 
-                words[w] = []string{strconv.Itoa(m.save_addr)}
+                words[w] = []Token{Token{strconv.Itoa(m.save_addr), pos}}
+                m.save_keys[w] = float64(m.save_addr)
+                m.save_owner[w] = cur_word
                 m.save_addr += 1
-                words[cur_word] = append(words[cur_word], w, "!")
+                words[cur_word] = append(words[cur_word], token, Token{"!", pos})
+                mode = mode[:len(mode)-1]
+
+            case M_CONTROL_INFO:
+                if w != "}" {
+                    // the scanner splits -1 and 1e3 into several words, so join up what had no space between
+                    text := scanner.Text()
+                    if len(info) > 0 && pos == info_end {
+                        info[len(info)-1] += text
+                    } else {
+                        info = append(info, text)
+                    }
+                    info_end = Pos{pos.File, pos.Line, pos.Col + utf8.RuneCountInString(text)}
+                    break
+                }
+                described, err := parse_control_info(info_for, info)
+                if err != nil {
+                    return words, imports, nil, error_at(PHASE_SCAN, pos, w, "%v", err)
+                }
+                m.control_info[info_for] = described
+                _, set := m.controls[info_for]
+                if !set {
+                    m.controls[info_for] = described.Default
+                }
+                mode = mode[:len(mode)-1]
+
+            case M_SAMPLE:
+                _, exists := words[w]
+                if exists {
+                    return words, imports, nil, error_at(PHASE_SCAN, pos, w, "%s has already been defined", w)
+                }
+                _, exists = WORDS[w]
+                if exists {
+                    return words, imports, nil, error_at(PHASE_SCAN, pos, w, "%s is a built-in word and cannot be redefined", w)
+                }
+                table, err := m.load_sample(w)
+                if err != nil {
+                    return words, imports, nil, error_at(PHASE_PROGRAM, pos, w, "can't load sample %s: %v", w, err)
+                }
+                id, loaded := m.table_ids[w]
+                if !loaded {
+                    id = len(m.tables)
+                    m.tables = append(m.tables, nil)
+                    m.table_ids[w] = id
+                }
+                m.tables[id] = table
+                words[w] = []Token{Token{strconv.Itoa(id), pos}}
+                mode = mode[:len(mode)-1]
+
+            case M_TUNING:
+                if edo > 0 {
+                    if w != "EDO" {
+                        return words, imports, nil, error_at(PHASE_SCAN, pos, w, "expected EDO after TUNING %d", edo)
+                    }
+                    tuning, edo = EqualTemperament(edo), 0
+                    mode = mode[:len(mode)-1]
+                    break
+                }
+
+                switch w {
+                    case "EQUAL":
+                        tuning = EqualTemperament(12)
+                    case "JUST":
+                        tuning = JustIntonation()
+                    case "PYTHAGOREAN":
+                        tuning = Pythagorean()
+                    default:
+                        n, err := strconv.Atoi(w)
+                        if err == nil {
+                            if n < 1 {
+                                return words, imports, nil, error_at(PHASE_SCAN, pos, w, "can't divide the octave into %d", n)
+                            }
+                            edo = n
+                            continue
+                        }
+                        tuning, err = m.load_tuning(w)
+                        if err != nil {
+                            return words, imports, nil, error_at(PHASE_PROGRAM, pos, w, "can't load tuning %s: %v", w, err)
+                        }
+                }
                 mode = mode[:len(mode)-1]
 
             case M_DEF:
                 switch w {
                     case ":":
-                        return words, imports, fmt.Errorf("Scan error: : found inside definition")
+                        return words, imports, nil, error_at(PHASE_SCAN, pos, w, ": found inside definition")
+                    case "TUNING":
+                        return words, imports, nil, error_at(PHASE_SCAN, pos, w, "TUNING found inside definition")
+                    case "SAMPLE":
+                        return words, imports, nil, error_at(PHASE_SCAN, pos, w, "SAMPLE found inside definition")
                     case ")":
-                        return words, imports, fmt.Errorf("Scan error: ) found outside comment")
+                        return words, imports, nil, error_at(PHASE_SCAN, pos, w, ") found outside comment")
                     case ";":
                         cur_word = ""
                         mode = mode[:len(mode)-1]
@@ -218,93 +826,331 @@ func (m *OpcodeMachine) read( in io.Reader, words map[string][]string ) (map[str
                         mode = append(mode, M_COMMENT)
                     case "CONSTANT", "CONTROL":
                         mode = append(mode, M_CONSTANT)
+                    case "{":
+                        if after_control == "" {
+                            return words, imports, nil, error_at(PHASE_SCAN, pos, w, "{ found without CONTROL before it")
+                        }
+                        info_for, info = after_control, nil
+                        mode = append(mode, M_CONTROL_INFO)
+                    case "KEEP":
+                        mode = append(mode, M_KEEP)
+                    default:
+                        words[cur_word] = append(words[cur_word], token)
+                }
+
+            case M_IMPORT:
+                switch w {
+                    case ":":
+                        return words, imports, nil, error_at(PHASE_SCAN, pos, w, ": found inside import statement")
+                    case "(":
+                        mode = append(mode, M_COMMENT)
+                    case ")":
+                        return words, imports, nil, error_at(PHASE_SCAN, pos, w, ") found outside comment")
+                    case ";":
+                        mode = mode[:len(mode)-1]
+                    default:
+                        imports = append(imports, token)
+                }
+
+            case M_COMMENT:
+                switch w {
+                    case "(":
+                        mode = append(mode, M_COMMENT)
+                    case ")":
+                        mode = mode[:len(mode)-1]
+                }
+
+            case M_NORMAL:
+                switch w {
+                    case ":":
+                        mode = append(mode, M_COLON)
+                    case "(":
+                        mode = append(mode, M_COMMENT)
+                    case ";":
+                        return words, imports, nil, error_at(PHASE_SCAN, pos, w, "; found outside definition")
+                    case ")":
+                        return words, imports, nil, error_at(PHASE_SCAN, pos, w, ") found outside comment")
+                    case "CONSTANT", "CONTROL":
+                        mode = append(mode, M_CONSTANT)
+                    case "{":
+                        if after_control == "" {
+                            return words, imports, nil, error_at(PHASE_SCAN, pos, w, "{ found without CONTROL before it")
+                        }
+                        info_for, info = after_control, nil
+                        mode = append(mode, M_CONTROL_INFO)
                     case "KEEP":
                         mode = append(mode, M_KEEP)
+                    case "TUNING":
+                        mode = append(mode, M_TUNING)
+                    case "SAMPLE":
+                        mode = append(mode, M_SAMPLE)
                     default:
-                        words[cur_word] = append(words[cur_word], w)
+                        words[cur_word] = append(words[cur_word], token)
                 }
+        }
+        if m.config.Debug {
+            m.config.Logger.Println("scan",w,"at",pos," -- ",mode)
+        }
+    }
+
+    if mode[len(mode)-1] == M_TUNING {
+        return words, imports, nil, error_at(PHASE_SCAN, scanner.Pos(), "TUNING", "TUNING with no tuning")
+    }
+    if mode[len(mode)-1] == M_CONTROL_INFO {
+        return words, imports, nil, error_at(PHASE_SCAN, scanner.Pos(), "{", "{ with no }")
+    }
+    if mode[len(mode)-1] == M_SAMPLE {
+        return words, imports, nil, error_at(PHASE_SCAN, scanner.Pos(), "SAMPLE", "SAMPLE with no name")
+    }
+
+    err := scanner.Err()
+    if err != nil {
+        return words, imports, nil, error_at(PHASE_SCAN, scanner.Pos(), "", "%v", err)
+    }
+
+    return words, imports, tuning, nil
+}
+
+/* The tuning in a Scala file called name.scl, from wherever packages come from */
+
+func (m *OpcodeMachine) load_tuning( name string ) (Tuning, error) {
+    if m.config.Imports == nil {
+        return nil, fmt.Errorf("no packages configured")
+    }
+    text, err := m.config.Imports(name + ".SCL")
+    if err != nil {
+        return nil, err
+    }
+    return ParseScala(text)
+}
+
+/* The sound in a WAV file called name.wav, from wherever packages come from */
+
+func (m *OpcodeMachine) load_sample( name string ) (*Table, error) {
+    if m.config.Imports == nil {
+        return nil, fmt.Errorf("no packages configured")
+    }
+    data, err := m.config.Imports(name + ".WAV")
+    if err != nil {
+        return nil, err
+    }
+    return ReadWAV(strings.NewReader(data))
+}
+
+/* The tuning the program is using */
+
+func (m *OpcodeMachine) tuned() Tuning {
+    if m.tuning != nil {
+        return m.tuning
+    }
+    return m.config.Tuning
+}
+
+/* Give each voice of a VOICES site its own slots for the KEEPs and CONSTANTs in patch
+   and the words it uses, and for the state of words compiled into it (from state slot
+   state_from on). Controls aren't moved, as all the voices share them */
+
+func (m *OpcodeMachine) add_voices( site int, patch string, state_from int ) {
+    used := map[string]bool{}
+    m.uses(patch, used)
+
+    names := []string{}
+    for name := range m.save_keys {
+        _, control := m.control_keys[name]
+        if used[m.save_owner[name]] && !control {
+            names = append(names, name)
+        }
+    }
+    sort.Strings(names)
+
+    slots, states := m.save_addr - SAVE_BASE, m.state_addr
+    for len(m.voice_slots) < (site+1) * m.config.Polyphony {
+        m.voice_slots = append(m.voice_slots, nil)
+        m.voice_states = append(m.voice_states, nil)
+    }
+    for v := 0; v < m.config.Polyphony; v++ {
+        moved := make([]int, slots)
+        for i := range moved {
+            moved[i] = i
+        }
+        for _, name := range names {
+            moved[int(m.save_keys[name]) - SAVE_BASE] = m.save_addr - SAVE_BASE
+            m.save_addr += 1
+        }
+        m.voice_slots[site * m.config.Polyphony + v] = moved
+
+        moved = make([]int, states)
+        for i := range moved {
+            moved[i] = i
+        }
+        for i := state_from; i < states; i++ {
+            moved[i] = m.state_addr
+            m.state_addr += 1
+        }
+        m.voice_states[site * m.config.Polyphony + v] = moved
+    }
+}
+
+/* Where in states the value of state slot `slot` for iteration iter goes.
+   Inside a voice (block > 0), the voice's own state is somewhere else */
+
+func (m *OpcodeMachine) state_index( iter int64, slot int, block int ) int {
+    if block > 0 && slot < len(m.voice_states[block-1]) {
+        slot = m.voice_states[block-1][slot]
+    }
+    return int(iter % 2) * m.state_slots + slot
+}
+
+/* The state a word with its state at addr kept in slot k last sample, or 0 if it didn't */
+
+func (m *OpcodeMachine) state( iter int64, addr float64, k int, block int ) float64 {
+    if !m.has_state(iter, addr, k, block) {
+        return 0
+    }
+    return m.states[m.state_index(iter - 1, int(addr) + k, block)]
+}
+
+/* Whether the word kept anything in slot k last sample, as it won't have the first time */
+
+func (m *OpcodeMachine) has_state( iter int64, addr float64, k int, block int ) bool {
+    if iter < 1 {
+        return false
+    }
+    return m.state_at[m.state_index(iter - 1, int(addr) + k, block)] == iter - 1
+}
+
+func (m *OpcodeMachine) keep_state( iter int64, addr float64, k int, block int, value float64 ) {
+    i := m.state_index(iter, int(addr) + k, block)
+    m.states[i], m.state_at[i] = value, iter
+}
+
+/* Where word w is in the program: the words it's inside, outermost first */
 
-            case M_IMPORT:
-                switch w {
-                    case ":":
-                        return words, imports, fmt.Errorf("Scan error: : found inside import statement")
-                    case "(":
-                        mode = append(mode, M_COMMENT)
-                    case ")":
-                        return words, imports, fmt.Errorf("Scan error: ) found outside comment")
-                    case ";":
-                        mode = mode[:len(mode)-1]
-                    default:
-                        imports = append(imports, w)
-                }
+func place( breadcrumb []string, word string, w string ) string {
+    return strings.Join(append(append([]string{}, breadcrumb...), word, w), " ")
+}
 
-            case M_COMMENT:
-                switch w {
-                    case "(":
-                        mode = append(mode, M_COMMENT)
-                    case ")":
-                        mode = mode[:len(mode)-1]
-                }
+/* Name the n slots from addr belonging to the word at place, counting how many times
+   that place has come up already, so the same word in the same place in a new program
+   gets the same names */
 
-            case M_NORMAL:
-                switch w {
-                    case ":":
-                        mode = append(mode, M_COLON)
-                    case "(":
-                        mode = append(mode, M_COMMENT)
-                    case ";":
-                        return words, imports, fmt.Errorf("Scan error: ; found outside definition")
-                    case ")":
-                        return words, imports, fmt.Errorf("Scan error: ) found outside comment")
-                    case "CONSTANT":
-                        mode = append(mode, M_CONSTANT)
-                    case "KEEP":
-                        mode = append(mode, M_KEEP)
-                    default:
-                        words[cur_word] = append(words[cur_word], w)
-                }
-        }
-        if DEBUG {
-            fmt.Println("scan",w," -- ",mode)
+func name_slots( names map[string]int, place string, addr int, n int ) {
+    count := 0
+    for {
+        _, used := names[fmt.Sprintf("%s #%d.0", place, count)]
+        if !used {
+            break
         }
+        count += 1
     }
+    for k := 0; k < n; k++ {
+        names[fmt.Sprintf("%s #%d.%d", place, count, k)] = addr + k
+    }
+}
 
-    err := scanner.Err()
+/* Add word and every defined word it uses to used */
 
-    return words, imports, err
+func (m *OpcodeMachine) uses( word string, used map[string]bool ) {
+    if used[word] {
+        return
+    }
+    used[word] = true
+    for _, t := range m.words[word] {
+        w := strings.ToUpper(t.word)
+        _, ok := m.words[w]
+        if ok {
+            m.uses(w, used)
+        }
+    }
 }
 
-func (m *OpcodeMachine) compile( code []float64, word string, breadcrumb []string ) ([]float64, error) {
+/* Append the opcodes for token to code, and the position each came from to code_pos */
+
+func (m *OpcodeMachine) compile( code []Instruction, code_pos []Pos, token Token, breadcrumb []string ) ([]Instruction, []Pos, error) {
     var err error
 
-    //word = strings.ToUpper(word)
+    word := token.word
 
     defn, ok := m.words[word]
     if ok {
 
-        if DEBUG {
-            fmt.Println(word,"=",defn,"--",breadcrumb)
+        if m.config.Debug {
+            m.config.Logger.Println(word,"=",defn,"--",breadcrumb)
         }
 
         // word is a defined word
         for _, outer_word := range breadcrumb {
             if outer_word == word {
-                return code, fmt.Errorf("Compile error: recursive definition %s", breadcrumb)
+                return code, code_pos, error_at(PHASE_COMPILE, token.pos, word, "recursive definition %s", breadcrumb)
             }
         }
 
-        for _, w := range defn {
-            w = strings.ToUpper(w)
+        for i := 0; i < len(defn); i++ {
+            t := defn[i]
+            t.word = strings.ToUpper(t.word)
+            if t.pos.Line == 0 {
+                // built in definitions are wherever they were used
+                t.pos = token.pos
+            }
+
+            word_info, ok := WORDS[t.word]
+            _, defined := m.words[t.word]
+            freq, used, is_note := 0.0, 0, false
+            if !ok && !defined {
+                freq, used, is_note = note(m.tuned(), defn, i)
+            }
+
+            if ok && word_info.opcode == W_VOICES {
+                // the patch after VOICES runs once for each voice, between VOICES and END_VOICES
+                if i+1 >= len(defn) || m.words[strings.ToUpper(defn[i+1].word)] == nil {
+                    return code, code_pos, error_at(PHASE_COMPILE, t.pos, t.word, "VOICES needs a defined word to play")
+                }
+                i += 1
+                patch := Token{strings.ToUpper(defn[i].word), defn[i].pos}
+                if patch.pos.Line == 0 {
+                    patch.pos = token.pos
+                }
+
+                code = append(code, Instruction{W_VOICES, float64(m.voice_sites), 0, nil})
+                code_pos = append(code_pos, t.pos)
+                site, state_from := m.voice_sites, m.state_addr
+                name_slots(m.voice_keys, place(breadcrumb, word, "VOICES " + patch.word), site, 1)
+                m.voice_sites += 1
 
-            word_info, ok := WORDS[w]
-            if ok {
-                code = append(code, word_info.opcode)
-                m.opcode_info[word_info.opcode] = word_info
+                code, code_pos, err = m.compile( code, code_pos, patch, append(breadcrumb, word) )
+                if err != nil {
+                    return code, code_pos, err
+                }
+                m.add_voices(site, patch.word, state_from)
+                code = append(code, Instruction{W_END_VOICES, 0, 0, nil})
+                code_pos = append(code_pos, t.pos)
+            } else if ok && word_info.state > 0 {
+                // somewhere of its own to keep state in, which is where the value goes
+                code = append(code, Instruction{word_info.opcode, float64(m.state_addr), 0, nil})
+                code_pos = append(code_pos, t.pos)
+                if word_info.opcode >= W_DELAY && word_info.opcode <= W_ALLPASS {
+                    m.delay_slots = append(m.delay_slots, m.state_addr)
+                }
+                name_slots(m.state_keys, place(breadcrumb, word, t.word), m.state_addr, word_info.state)
+                m.state_addr += word_info.state
+                m.stateful = true
+            } else if ok {
+                code = append(code, Instruction{word_info.opcode, 0, 0, nil})
+                code_pos = append(code_pos, t.pos)
+                if word_info.opcode == W_CLIP {
+                    // sets the machine's clip level, which the workers can't all do at once
+                    m.stateful = true
+                }
+            } else if is_note {
+                // note names are frequencies, ready to multiply by T
+                code = append(code, Instruction{W_NUMBER, freq * m.config.Loop, 0, nil})
+                code_pos = append(code_pos, t.pos)
+                i += used - 1
             } else {
                 new_breadcrumb := append(breadcrumb, word)
-                code, err = m.compile( code, w, new_breadcrumb )
+                code, code_pos, err = m.compile( code, code_pos, t, new_breadcrumb )
                 if err != nil {
-                    return code, err
+                    return code, code_pos, err
                 }
             }
         }
@@ -312,650 +1158,1051 @@ func (m *OpcodeMachine) compile( code []float64, word string, breadcrumb []strin
 
         num, err := strconv.ParseFloat(word, 64)
         if err != nil {
-            return code, fmt.Errorf("Compile error: unknown word %s", word)
+            return code, code_pos, error_at(PHASE_COMPILE, token.pos, word, "unknown word %s", word)
         }
-        code = append(code, W_NUMBER, num)
+        code = append(code, Instruction{W_NUMBER, num, 0, nil})
+        code_pos = append(code_pos, token.pos)
     }
-    return code, err
+    return code, code_pos, err
 }
 
-func (m *OpcodeMachine) optimize( code []float64 ) ([]float64, error) {
-    var output []float64
+/* Evaluate everything between [ ] now, and link what's left so it's ready to run */
 
-    literal := []float64{}
+func (m *OpcodeMachine) optimize( code []Instruction, code_pos []Pos ) ([]Instruction, []Pos, error) {
+    var output []Instruction
+    var output_pos []Pos
+
+    literal := []Instruction{}
+    literal_pos := []Pos{}
+    var literal_start Pos
 
     mode := []int{M_NORMAL}
 
-    for _, w := range code {
+    for i := 0; i < len(code); i++ {
+        w, pos := code[i], code_pos[i]
         switch mode[len(mode)-1] {
             case M_LITERAL:
-                switch w {
+                switch w.op {
                     case W_BEGIN_LITERAL:
                         mode = append(mode, M_LITERAL)
                     case W_END_LITERAL:
                         mode = mode[:len(mode)-1]
                         if mode[len(mode)-1] == M_NORMAL {
                             // outside [], time to evaluate
-                            literal = append(literal, W_EOF)
-                            if DEBUG == true {
-                                fmt.Println("Evaluating literal:",literal)
+                            literal = append(literal, Instruction{W_EOF, 0, 0, nil})
+                            literal_pos = append(literal_pos, pos)
+                            if m.config.Debug {
+                                m.config.Logger.Println("Evaluating literal:",literal)
+                            }
+                            err := link(literal, literal_pos)
+                            if err != nil {
+                                return output, output_pos, err
                             }
                             literal_output, literal_stack, err := m.RunCode(literal,-1)
-                            if DEBUG == true {
-                                fmt.Println("Replacing with",literal_stack)
+                            if m.config.Debug {
+                                m.config.Logger.Println("Replacing with",literal_stack)
                             }
                             if err != nil {
-                                return output, err
+                                err = locate(err, literal_pos)
+                                e, ok := err.(*Error)
+                                if ok {
+                                    e.Phase = PHASE_OPTIMIZE
+                                }
+                                return output, output_pos, err
                             }
                             if len(literal_output) > 0 {
-                                return output, fmt.Errorf("Optimize error: attempted output from within [ ]")
+                                return output, output_pos, error_at(PHASE_OPTIMIZE, literal_start, "[", "attempted output from within [ ]")
                             }
                             for _, value := range literal_stack {
-                                output = append(output, W_NUMBER, value)
+                                output = append(output, Instruction{W_NUMBER, value, 0, nil})
+                                output_pos = append(output_pos, literal_start)
                             }
-                            literal = []float64{}
+                            literal = []Instruction{}
+                            literal_pos = []Pos{}
                         }
                     default:
                         literal = append(literal, w)
+                        literal_pos = append(literal_pos, pos)
                 }
             case M_NORMAL:
-                switch w {
+                switch w.op {
                     case W_BEGIN_LITERAL:
                         mode = append(mode, M_LITERAL)
+                        literal_start = pos
                     case W_END_LITERAL:
-                        return output, fmt.Errorf("Optimize error: ] found outside literal")
+                        return output, output_pos, error_at(PHASE_OPTIMIZE, pos, "]", "] found outside literal")
                     default:
                         output = append(output, w)
+                        output_pos = append(output_pos, pos)
                 }
         }
     }
 
     // if EOF during a literal, tack it on the end
-    for _, w := range literal {
-        output = append(output, w)
+    output = append(output, literal...)
+    output_pos = append(output_pos, literal_pos...)
+
+    return output, output_pos, link(output, output_pos)
+}
+
+/* Fill in where each control word in code goes next. A block still open at the
+   end of the code runs to the end, as it would have done before linking */
+
+func link( code []Instruction, code_pos []Pos ) error {
+    open := []int{}   // the IF, FROM or DO starting each block we're inside
+    exits := [][]int{} // the ELSEs and ,s in each of those blocks
+
+    loops := 0         // how many of them are DOs
+
+    for i := range code {
+        op := code[i].op
+        if loops > 0 && OPCODES[op].state > 0 {
+            // every pass would run the same instruction, so they'd all share its state
+            return error_at(PHASE_COMPILE, code_pos[i], OPCODES[op].name, "words keeping state can't go inside DO...LOOP")
+        }
+        switch op {
+            case W_IF, W_FROM:
+                code[i].branches = []int{i+1}
+                open = append(open, i)
+                exits = append(exits, []int{})
+            case W_DO, W_VOICES:
+                open = append(open, i)
+                exits = append(exits, []int{})
+                if op == W_DO {
+                    loops++
+                }
+
+            case W_ELSE, W_CHOOSE_SEP:
+                start, msg := W_IF, "ELSE outside IF...THEN"
+                if op == W_CHOOSE_SEP {
+                    start, msg = W_FROM, ", outside FROM...CHOOSE"
+                }
+                if len(open) < 1 || code[open[len(open)-1]].op != start {
+                    return error_at(PHASE_COMPILE, code_pos[i], OPCODES[op].name, "%s", msg)
+                }
+                top := open[len(open)-1]
+                code[top].branches = append(code[top].branches, i+1)
+                exits[len(exits)-1] = append(exits[len(exits)-1], i)
+
+            case W_THEN, W_CHOOSE, W_LOOP, W_END_VOICES:
+                start, msg := W_IF, "THEN without preceding IF"
+                if op == W_CHOOSE {
+                    start, msg = W_FROM, "CHOOSE without preceding FROM"
+                } else if op == W_LOOP {
+                    start, msg = W_DO, "LOOP without preceding DO"
+                } else if op == W_END_VOICES {
+                    start, msg = W_VOICES, "VOICES patch isn't finished"
+                }
+                if len(open) < 1 || code[open[len(open)-1]].op != start {
+                    return error_at(PHASE_COMPILE, code_pos[i], OPCODES[op].name, "%s", msg)
+                }
+                top := open[len(open)-1]
+                code[top].jump = i+1
+                for _, exit := range exits[len(exits)-1] {
+                    code[exit].jump = i+1
+                }
+                if op == W_LOOP || op == W_END_VOICES {
+                    code[i].jump = top+1
+                }
+                if op == W_LOOP {
+                    loops--
+                }
+                open, exits = open[:len(open)-1], exits[:len(exits)-1]
+        }
+    }
+
+    for k, top := range open {
+        code[top].jump = len(code)
+        for _, exit := range exits[k] {
+            code[exit].jump = len(code)
+        }
     }
 
-    return output, nil //TODO
+    return nil
 }
 
 func (m *OpcodeMachine) Fill32( buf []float32 ) error {
-    if m.workers == 1 {
-        return m.fill32_single(buf)
+    return m.FillInterleaved32(buf, 1)
+}
+
+/* Fill buf with frames of `channels` samples each. Output to a channel the buffer
+   doesn't have wraps round, so everything ends up in a mono buffer */
+
+func (m *OpcodeMachine) FillInterleaved32( buf []float32, channels int ) error {
+    if channels < 1 || len(buf) % channels != 0 {
+        return fmt.Errorf("Fill error: buffer of %d can't be split into %d channels", len(buf), channels)
+    }
+
+    if m.parallel() {
+        return m.fill32_parallel(buf, channels)
     } else {
-        return m.fill32_parallel(buf)
+        return m.fill32_single(buf, channels)
     }
 }
 
-func (m *OpcodeMachine) fill32_parallel( buf []float32 ) error {
+/* Whether samples can be shared out between the workers. A word which keeps state
+   needs the last sample finished first, and CLIP changes the machine itself, so a
+   program with either runs a sample at a time */
 
-    jobs := make(chan *Job, len(buf))
-    results := make(chan *JobResult, len(buf))
+func (m *OpcodeMachine) parallel() bool {
+    return m.config.Workers > 1 && !m.stateful && (m.fade_from == nil || !m.fade_from.stateful)
+}
 
-    for w := 0; w <= m.workers; w++ {
-        go m.work()
-    }
+func (m *OpcodeMachine) fill32_parallel( buf []float32, channels int ) error {
 
-    for i := range buf {
-        jobs <- &Job{i, m.iter}
-        m.iter++
+    jobs := make(chan *Job, m.config.Workers)
+    results := make(chan *JobResult, m.config.Workers)
+
+    for w := 0; w < m.config.Workers; w++ {
+        go m.work(jobs, results)
     }
-    close(jobs)
+    defer close(jobs)
+
+    frames := len(buf) / channels
+    sums := make([]float64, channels)
+
+    /* Frames are handed out in batches of one per worker, and each batch
+       must finish before the next starts. This is what lets DELTA and
+       PREWARP rely on the sample `workers` iterations back being complete,
+       and why save_len must be at least 2*workers */
+
+    for start := 0; start < frames; start += m.config.Workers {
+        end := start + m.config.Workers
+        if end > frames {
+            end = frames
+        }
+
+        for i := start; i < end; i++ {
+            m.iter++
+            jobs <- &Job{i, m.iter}
+        }
 
-    for result := range results {
-        if result.err != nil {
-            return result.err
+        var err error
+        for i := start; i < end; i++ {
+            result := <-results
+            if result.err != nil {
+                if err == nil {
+                    err = result.err
+                }
+                continue
+            }
+            m.mix(result.value, sums, buf[result.id*channels:(result.id+1)*channels])
         }
 
-        r := float64(0)
-        for _, s := range result.value {
-            if s < -1 { s = -1 }
-            if s > 1  { s = 1 }
-            r += s
+        if err != nil {
+            return err
         }
-        buf[result.id] = float32( r / m.clip )
+
+        m.end_fade()
     }
-    //fmt.Println(output, i)
 
     return nil
 }
 
-func (m *OpcodeMachine) fill32_single( buf []float32 ) error {
-    var output []float64
+func (m *OpcodeMachine) fill32_single( buf []float32, channels int ) error {
+    var output []Output
     var err error
 
-    for i := range buf {
+    sums := make([]float64, channels)
 
-        output, err = m.Run()
+    for i := 0; i < len(buf); i += channels {
+
+        m.iter += 1
+        output, err = m.run_iter(m.iter)
+        m.end_fade()
 
         if (err != nil) {
             return err
         }
 
-        r := float64(0)
-        for _, s := range output {
-            if s < -1 { s = -1 }
-            if s > 1  { s = 1 }
-            r += s
-        }
+        m.mix(output, sums, buf[i:i+channels])
+    }
+
+    return err
+}
 
-        buf[i] = float32(r / m.clip)
+/* Sum one iteration's output into frame, using sums as scratch space */
+
+func (m *OpcodeMachine) mix( output []Output, sums []float64, frame []float32 ) {
+    for c := range sums {
+        sums[c] = 0
     }
 
-    //fmt.Println(output, i)
+    for _, o := range output {
+        s := o.Value
+        if s < -1 { s = -1 }
+        if s > 1  { s = 1 }
+        if o.Channel == ALL_CHANNELS {
+            for c := range sums {
+                sums[c] += s
+            }
+        } else {
+            sums[o.Channel % len(sums)] += s
+        }
+    }
 
-    return err
+    for c, r := range sums {
+        frame[c] = float32(r / m.clip)
+    }
 }
 
 func (m *OpcodeMachine) Run() ([]float64, error) {
     m.iter += 1
-    save_ptr := m.save_len - int(m.iter % int64(m.save_len))
+    output, err := m.run_iter(m.iter)
+    m.end_fade()
 
-    m.saves[save_ptr] = map[float64]float64{}
-    for k,v := range m.control_keys {
-      control_value, ok := m.controls[k]
-      if ok {
-        m.saves[save_ptr][v] = control_value
-      }
+    values := make([]float64, len(output))
+    for i, o := range output {
+        values[i] = o.Value
     }
 
-    output, stack, err := m.RunCode(m.code, m.iter)
+    return values, err
+}
+
+func (m *OpcodeMachine) run_iter( iter int64 ) ([]Output, error) {
+    m.start_saves(iter)
+
+    output, stack, err := m.RunCode(m.code, iter)
 
     if err != nil {
-        return output, err
+        return output, locate(err, m.code_pos)
     }
 
     if len(stack) != 0 {
-        return output, fmt.Errorf("Runtime error: stack not empty at end of run: %f", stack)
+        return output, &Error{PHASE_RUNTIME, Pos{}, "", fmt.Sprintf("stack not empty at end of run: %f", stack), -1}
+    }
+
+    if m.fade_from != nil && iter < m.fade_end {
+        fade_output, err := m.fade_from.run_iter(iter)
+        if err != nil {
+            return output, err
+        }
+
+        fade := float64(m.fade_end - iter) / float64(m.fade_len)
+        for i := range output {
+            output[i].Value *= 1 - fade
+        }
+        for _, o := range fade_output {
+            output = append(output, Output{o.Channel, o.Value * fade})
+        }
     }
 
     return output, nil
 }
 
-func (m *OpcodeMachine) work() (jobs chan *Job) {
+/* Forget the previous program once the crossfade is over. Not safe to call while workers are running */
+
+func (m *OpcodeMachine) end_fade() {
+    if m.fade_from != nil && m.iter >= m.fade_end {
+        m.fade_from = nil
+    }
+}
+
+/* Store the controls for this iteration */
+
+func (m *OpcodeMachine) start_saves( iter int64 ) {
+    for k, addr := range m.control_keys {
+        control_value, ok := m.controls[k]
+        if ok {
+            if m.config.Smoothing > 0 && iter > 0 {
+                // glide from last sample's value, which is why smoothing makes the machine stateful
+                last := m.save_index(iter - 1, addr, 0)
+                if m.saved_at[last] == iter - 1 {
+                    control_value = lag_step(m.saves[last], control_value, m.config.Smoothing * m.config.SampleRate)
+                }
+            }
+            i := m.save_index(iter, addr, 0)
+            m.saves[i] = control_value
+            m.saved_at[i] = iter
+        }
+    }
+}
+
+func (m *OpcodeMachine) work( jobs chan *Job, results chan *JobResult ) {
     for j := range jobs {
-        fmt.Println("doing job",j)
-        output, _, err := m.RunCode(m.code, j.iter)
-        fmt.Println("output",output,err)
-        //results <- JobResult{j.id, output, err}
+        output, err := m.run_iter(j.iter)
+        results <- &JobResult{j.id, output, err}
     }
-    return nil
 }
 
-func (m *OpcodeMachine) RunCode(code []float64, iter int64) ([]float64, []float64, error) {
+func (m *OpcodeMachine) RunCode(code []Instruction, iter int64) ([]Output, []float64, error) {
 
-    output := []float64{}
+    output := []Output{}
     stack := []float64{}
 
-    save_ptr := m.save_len - int(m.iter % int64(m.save_len))
-
-    _, phase := math.Modf( float64(m.iter) * m.step * 2 * math.Pi )
+    _, phase := math.Modf( float64(iter) * m.step * 2 * math.Pi )
 
     var err error
     var pop float64
-    var w_info Word
-
-    choose_value := []int{}
+    var w_info *Word
+
+    loops := []LoopState{}
+    loop_count := 0
+    voices := []VoiceState{}
+    block := 0 // where the current voice's KEEPs are, 0 outside VOICES
+    now := float64(iter) / m.config.SampleRate
+    seed := m.config.Seed // until SEED
     code_ptr := 0
     top := -1
 
-    mode_breadcrumb := []int{}
-    mode := M_NORMAL
+    for code_ptr < len(code) {
+        ins := &code[code_ptr]
+        w := ins.op
+        if w == W_EOF {
+            break
+        }
+        w_info = &OPCODES[w]
+        next := code_ptr + 1
+
+        if w_info.needs > top+1 {
+            return output, stack, runtime_error(code_ptr, w_info.name, "%s needs %d items on stack, got %v", w_info.name, w_info.needs, stack)
+        }
+        if w_info.state > 0 && iter < 0 {
+            return output, stack, runtime_error(code_ptr, w_info.name, "tried to fetch at iteration %d (fetch within literal?)", iter)
+        }
+        switch w {
+
+            case W_NOOP, W_BEGIN_LITERAL, W_END_LITERAL:
+                // noop
+            case W_NUMBER:
+                stack = append(stack, ins.value)
+                top += 1
+            case W_OUTPUT:
+                pop, stack = stack[top], stack[:top]
+                top -= 1
+                output = append(output, Output{ALL_CHANNELS, pop})
+            case W_DUP_OUTPUT:
+                output = append(output, Output{ALL_CHANNELS, stack[top]})
+            case W_CHANNEL:
+                var channel float64
+                channel, pop, stack = stack[top], stack[top-1], stack[:top-1]
+                top -= 2
+                if !(channel >= 0 && channel < math.MaxInt32) {
+                    // NaN and Inf too, which would make nonsense of int(channel)
+                    return output, stack, runtime_error(code_ptr, w_info.name, "no such channel %v", channel)
+                }
+                output = append(output, Output{int(channel), pop})
+            case W_LEFT:
+                pop, stack = stack[top], stack[:top]
+                top -= 1
+                output = append(output, Output{0, pop})
+            case W_RIGHT:
+                pop, stack = stack[top], stack[:top]
+                top -= 1
+                output = append(output, Output{1, pop})
+            case W_PAN:
+                /* ( value pan -- ) with pan from -1 (left) to 1 (right). The pan law
+                   is linear so that mixing down to mono doesn't change the level */
+                var pan float64
+                pan, pop, stack = math.Max(-1, math.Min(1, stack[top])), stack[top-1], stack[:top-1]
+                top -= 2
+                output = append(output, Output{0, pop * (1-pan) / 2}, Output{1, pop * (1+pan) / 2})
+            case W_CLIP:
+                pop, stack = stack[top], stack[:top]
+                top -= 1
+                m.clip = pop
+
+            /* Runtime control */
+
+            case W_FROM, W_IF:
+                var choice int
+                choice, stack = int(stack[top]), stack[:top]
+                top -= 1
+                if w == W_IF {
+                    choice = 1 - choice // true is the first branch
+                }
+                if choice >= 0 && choice < len(ins.branches) {
+                    next = ins.branches[choice]
+                } else {
+                    next = ins.jump
+                }
+
+            case W_CHOOSE_SEP, W_ELSE:
+                // end of the chosen branch
+                next = ins.jump
 
-    w := code[code_ptr]
+            case W_CHOOSE, W_THEN:
+                // noop
 
-    for w != W_EOF {
-        w_info = m.opcode_info[w]
-        switch mode {
-            case M_CHOOSE_FALSE:
-                switch w {
-                    case W_NUMBER:
-                        code_ptr += 1 // don't accidentally interpret 0 as EOF *doh*
-                    case W_FROM, W_IF:
-                        // not going to execute, but still need to keep track of nested chooses
-                        mode_breadcrumb = append(mode_breadcrumb, mode)
-                        choose_value = append(choose_value, -1)
-                    case W_CHOOSE, W_THEN:
-                        choose_value = choose_value[:len(choose_value)-1]
-                        var old_mode int
-                        old_mode, mode_breadcrumb = mode_breadcrumb[len(mode_breadcrumb)-1], mode_breadcrumb[:len(mode_breadcrumb)-1]
-                        mode = old_mode
-                    case W_CHOOSE_SEP, W_ELSE:
-                        choose_value[len(choose_value)-1] -= 1
-                        if choose_value[len(choose_value)-1] == 0 {
-                            mode = M_NORMAL
-                        }
+            /* Memory */
+
+            case W_PEEK:
+                i := m.save_index(iter, stack[top], block)
+                if i < 0 {
+                    return output, stack, runtime_error(code_ptr, w_info.name, "word before @ or ? was not a save name")
                 }
 
-            case M_NORMAL:
-                if w_info.needs > top+1 {
-                    return output, stack, fmt.Errorf("Runtime error: %s needs %d items on stack, got %v", w_info.name, w_info.needs, stack)
+                if iter < 0 {
+                    return output, stack, runtime_error(code_ptr, w_info.name, "tried to fetch at iteration %d (fetch within literal?)", iter)
                 }
-                switch w {
 
-                    case W_NOOP, W_BEGIN_LITERAL, W_END_LITERAL:
-                        // noop
-                    case W_NUMBER:
-                        code_ptr += 1
-                        stack = append(stack, code[code_ptr])
-                        top += 1
-                    case W_OUTPUT:
-                        pop, stack = stack[top], stack[:top]
-                        top -= 1
-                        output = append(output, pop)
-                    case W_DUP_OUTPUT:
-                        output = append(output, stack[top])
-                    case W_CLIP:
-                        pop, stack = stack[top], stack[:top]
-                        top -= 1
-                        m.clip = pop
-
-                    /* Runtime control */
-
-                    case W_FROM:
-                        var new_choose_value int
-                        new_choose_value, stack = int(stack[top]), stack[:top]
-                        choose_value = append(choose_value, new_choose_value)
-                        top -= 1
-                        mode_breadcrumb = append(mode_breadcrumb, mode)
-                        if new_choose_value != 0 {
-                            mode = M_CHOOSE_FALSE
-                        }
+                if m.saved_at[i] != iter {
+                    return output, stack, runtime_error(code_ptr, w_info.name, "nothing at address %v in iteration %d (controls are %v)", stack[top], iter, m.controls)
+                }
+                stack[top] = m.saves[i]
 
-                    case W_IF:
-                        var new_choose_value int
-                        new_choose_value, stack = 1-int(stack[top]), stack[:top]
-                        choose_value = append(choose_value, new_choose_value)
-                        top -= 1
-                        mode_breadcrumb = append(mode_breadcrumb, mode)
-                        if new_choose_value != 0 {
-                            mode = M_CHOOSE_FALSE
-                        }
+            case W_OLD:
+                pop, stack = stack[top], stack[:top]
+                top -= 1
 
-                    case W_CHOOSE_SEP:
-                        if len(choose_value) < 1 {
-                            return output, stack, fmt.Errorf("Runtime error: , outside FROM...CHOOSE")
-                        }
-                        choose_value[len(choose_value)-1] -= 1
-                        if choose_value[len(choose_value)-1] != 0 {
-                            mode = M_CHOOSE_FALSE
-                        }
+                back := int(pop * m.config.SampleRate * m.config.Loop / (2*math.Pi))
+                if back > 0 && back < m.config.Workers {
+                    /* Like DELTA, can't see the samples other workers
+                       are still busy with */
+                    back = m.config.Workers
+                }
 
-                    case W_ELSE:
-                        if len(choose_value) < 1 {
-                            return output, stack, fmt.Errorf("Runtime error: ELSE outside IF...THEN")
-                        }
-                        choose_value[len(choose_value)-1] -= 1
-                        if choose_value[len(choose_value)-1] != 0 {
-                            mode = M_CHOOSE_FALSE
-                        }
+                if iter < 0 {
+                    return output, stack, runtime_error(code_ptr, w_info.name, "tried to fetch at iteration %d (fetch within literal?)", iter)
+                }
 
-                    case W_CHOOSE:
-                        if len(choose_value) < 1 {
-                            return output, stack, fmt.Errorf("Runtime error: CHOOSE without preceding FROM")
-                        }
-                        choose_value = choose_value[:len(choose_value)-1]
-                        var old_mode int
-                        old_mode, mode_breadcrumb = mode_breadcrumb[len(mode_breadcrumb)-1], mode_breadcrumb[:len(mode_breadcrumb)-1]
-                        mode = old_mode
-
-                    case W_THEN:
-                        if len(choose_value) < 1 {
-                            return output, stack, fmt.Errorf("Runtime error: THEN without preceding IF")
-                        }
-                        choose_value = choose_value[:len(choose_value)-1]
-                        var old_mode int
-                        old_mode, mode_breadcrumb = mode_breadcrumb[len(mode_breadcrumb)-1], mode_breadcrumb[:len(mode_breadcrumb)-1]
-                        mode = old_mode
+                if m.save_index(iter, stack[top], block) < 0 {
+                    return output, stack, runtime_error(code_ptr, w_info.name, "bad save name %f passed to OLD", stack[top])
+                }
 
-                    /* Memory */
+                stack[top] = m.saved(iter, back, stack[top], block)
 
-                    case W_PEEK:
-                        if stack[top] < 1000 || stack[top] != math.Floor(stack[top]) {
-                            return output, stack, fmt.Errorf("Runtime error: word before @ or ? was not a save name")
-                        }
+            case W_DELTA:
+                /* Skip back by the number of workers, as we can't guarantee
+                   intervening samples have been filled in yet */
 
-                        if save_ptr >= len(m.saves) || save_ptr < 0 {
-                            return output, stack, fmt.Errorf("Runtime error: tried to fetch ptr %d (fetch within literal?)", save_ptr)
-                        }
+                if iter < 0 {
+                    return output, stack, runtime_error(code_ptr, w_info.name, "tried to fetch at iteration %d (fetch within literal?)", iter)
+                }
 
-                        val, ok := m.saves[save_ptr][stack[top]]
-                        if ok {
-                            stack[top] = val
-                        } else {
-                            return output, stack, fmt.Errorf("Runtime error: nothing at address %f at ptr %d, just %v (last %v)", stack[top], save_ptr, m.saves[save_ptr], m.controls)
-                        }
+                if m.save_index(iter, stack[top], block) < 0 {
+                    return output, stack, runtime_error(code_ptr, w_info.name, "bad save name %f passed to DELTA", stack[top])
+                }
 
-                    case W_OLD:
-                        pop, stack = stack[top], stack[:top]
-                        top -= 1
+                stack[top] = m.saved(iter, m.config.Workers, stack[top], block)
 
-                        old_ptr := (save_ptr + int(pop*m.sample_rate*BPM*60)) % m.save_len
+            case W_POKE:
+                if iter < 0 {
+                    return output, stack, runtime_error(code_ptr, w_info.name, "tried to store at iteration %d (store within literal?)", iter)
+                }
 
-                        if old_ptr >= len(m.saves) || old_ptr < 0 {
-                            return output, stack, fmt.Errorf("Runtime error: tried to fetch ptr %d (fetch within literal?)", old_ptr)
-                        }
+                i := m.save_index(iter, stack[top], block)
+                if i < 0 {
+                    return output, stack, runtime_error(code_ptr, w_info.name, "word before ! was not a save name")
+                }
 
-                        if stack[top] < 1000 || stack[top] != math.Floor(stack[top]) {
-                            return output, stack, fmt.Errorf("Runtime error: bad save name %f passed to OLD", stack[top])
-                        }
+                if m.saved_at[i] == iter {
+                    return output, stack, runtime_error(code_ptr, w_info.name, "address %v already set to %v", stack[top], m.saves[i])
+                } else {
+                    m.saves[i], m.saved_at[i] = stack[top-1], iter
+                    if m.config.Debug {
+                      m.config.Logger.Printf("Poked %v:%v\n", stack[top], stack[top-1])
+                    }
+                    stack = stack[:top-1]
+                    top -= 2
+                }
 
-                        val, ok := m.saves[old_ptr][stack[top]]
-                        //fmt.Printf("Looked at address %f at ptr %d (now %d): %s", stack[top], old_ptr, save_ptr, val)
-                        if ok {
-                            stack[top] = val
-                        } else {
-                            stack[top] = 0
-                        }
+            /* Forth words */
+
+            case W_TRUE:
+                stack = append(stack, 1)
+                top += 1
+            case W_FALSE:
+                stack = append(stack, 0)
+                top += 1
+
+            case W_PLUS:
+                pop, stack = stack[top], stack[:top]
+                top -= 1
+                stack[top] += pop
+            case W_MINUS:
+                pop, stack = stack[top], stack[:top]
+                top -= 1
+                stack[top] -= pop
+            case W_REVERSE_MINUS:
+                pop, stack = stack[top], stack[:top]
+                top -= 1
+                stack[top] = pop - stack[top]
+            case W_TIMES:
+                pop, stack = stack[top], stack[:top]
+                top -= 1
+                stack[top] *= pop
+            case W_DIVIDE:
+                pop, stack = stack[top], stack[:top]
+                if pop == 0 {
+                    return output, stack, runtime_error(code_ptr, w_info.name, "divide by zero")
+                }
+                top -= 1
+                stack[top] /= pop
+            case W_REVERSE_DIVIDE:
+                pop, stack = stack[top], stack[:top]
+                top -= 1
+                if stack[top] == 0 {
+                    return output, stack, runtime_error(code_ptr, w_info.name, "divide by zero")
+                }
+                stack[top] = pop / stack[top]
+            case W_MOD:
+                pop, stack = stack[top], stack[:top]
+                top -= 1
+                stack[top] = math.Mod( stack[top], pop )
+
+            case W_DMOD:
+                if stack[top] == 0 {
+                    return output, stack, runtime_error(code_ptr, w_info.name, "divide by zero")
+                }
+                result, remainder := math.Modf( stack[top-1] / stack[top] )
+                stack[top-1] = remainder * stack[top]
+                stack[top] = result
+
+            case W_EQUALS:
+                pop, stack = stack[top], stack[:top]
+                top -= 1
+                if stack[top] == stack[top-1] {
+                    stack = append(stack, 1)
+                } else {
+                    stack = append(stack, 0)
+                }
 
-                    case W_DELTA:
-                        /* Skip back by the number of workers, as we can't guarantee
-                           intervening samples have been filled in yet */
+            case W_GREATER:
+                pop, stack = stack[top], stack[:top]
+                top -= 1
+                if stack[top] > pop {
+                    stack[top] = 1
+                } else {
+                    stack[top] = 0
+                }
 
-                        old_ptr := (save_ptr + m.workers) % m.save_len
+            case W_LESS:
+                pop, stack = stack[top], stack[:top]
+                top -= 1
+                if stack[top] < pop {
+                    stack[top] = 1
+                } else {
+                    stack[top] = 0
+                }
 
-                        if old_ptr >= len(m.saves) || old_ptr < 0 {
-                            return output, stack, fmt.Errorf("Runtime error: tried to fetch ptr %d (fetch within literal?)", old_ptr)
-                        }
+            case W_NOT:
+                if stack[top] == 0 {
+                    stack[top] = 1
+                } else {
+                    stack[top] = 0
+                }
 
-                        if stack[top] < 1000 || stack[top] != math.Floor(stack[top]) {
-                            return output, stack, fmt.Errorf("Runtime error: bad save name %f passed to DELTA", stack[top])
-                        }
+            case W_AND:
+                pop, stack = stack[top], stack[:top]
+                top -= 1
+                if pop != 0 && stack[top] != 0 {
+                    stack[top] = 1
+                } else {
+                    stack[top] = 0
+                }
 
-                        val, ok := m.saves[old_ptr][stack[top]]
-                        //fmt.Printf("Looked at address %f at ptr %d (now %d): %s", stack[top], old_ptr, save_ptr, val)
-                        if ok {
-                            stack[top] = val
-                        } else {
-                            stack[top] = 0
-                        }
+            case W_OR:
+                pop, stack = stack[top], stack[:top]
+                top -= 1
+                if pop != 0 || stack[top] != 0 {
+                    stack[top] = 1
+                } else {
+                    stack[top] = 0
+                }
 
-                    case W_POKE:
-                        if save_ptr >= len(m.saves) || save_ptr < 0 {
-                            return output, stack, fmt.Errorf("Runtime error: tried to store ptr %d but save_len is %d", save_ptr, m.save_len)
-                        }
-                        if m.saves[save_ptr] == nil {
-                            m.saves[save_ptr] = map[float64]float64{}
-                        }
+            case W_DUP:
+                stack = append(stack, stack[top])
+                top += 1
 
-                        _, ok := m.saves[save_ptr][stack[top]]
-                        if ok {
-                            return output, stack, fmt.Errorf("Runtime error: address %f already set in %v", stack[top], m.saves[save_ptr])
-                        } else {
-                            var plop float64
-                            plop, pop, stack = stack[top-1], stack[top], stack[:top-1]
-                            top -= 2
-                            m.saves[save_ptr][pop] = plop
-                            if DEBUG {
-                              fmt.Printf("Poked %v:%v, now have %v\n", pop, plop, m.saves[save_ptr])
-                            }
-                        }
+            case W_DDUP:
+                stack = append(stack, stack[top-1], stack[top])
+                top += 2
 
-                    /* Forth words */
-
-                    case W_TRUE:
-                        stack = append(stack, 1)
-                        top += 1
-                    case W_FALSE:
-                        stack = append(stack, 0)
-                        top += 1
-
-                    case W_PLUS:
-                        pop, stack = stack[top], stack[:top]
-                        top -= 1
-                        stack[top] += pop
-                    case W_MINUS:
-                        pop, stack = stack[top], stack[:top]
-                        top -= 1
-                        stack[top] -= pop
-                    case W_REVERSE_MINUS:
-                        pop, stack = stack[top], stack[:top]
-                        top -= 1
-                        stack[top] = pop - stack[top]
-                    case W_TIMES:
-                        pop, stack = stack[top], stack[:top]
-                        top -= 1
-                        stack[top] *= pop
-                    case W_DIVIDE:
-                        pop, stack = stack[top], stack[:top]
-                        if pop == 0 {
-                            return output, stack, fmt.Errorf("Runtime error: divide by zero")
-                        }
-                        top -= 1
-                        stack[top] /= pop
-                    case W_REVERSE_DIVIDE:
-                        pop, stack = stack[top], stack[:top]
-                        top -= 1
-                        if stack[top] == 0 {
-                            return output, stack, fmt.Errorf("Runtime error: divide by zero")
-                        }
-                        stack[top] = pop / stack[top]
-                    case W_MOD:
-                        pop, stack = stack[top], stack[:top]
-                        top -= 1
-                        stack[top] = math.Mod( stack[top], pop )
-
-                    case W_DMOD:
-                        if stack[top] == 0 {
-                            return output, stack, fmt.Errorf("Runtime error: divide by zero")
-                        }
-                        result, remainder := math.Modf( stack[top-1] / stack[top] )
-                        stack[top-1] = remainder * stack[top]
-                        stack[top] = result
-
-                    case W_EQUALS:
-                        pop, stack = stack[top], stack[:top]
-                        top -= 1
-                        if stack[top] == stack[top-1] {
-                            stack = append(stack, 1)
-                        } else {
-                            stack = append(stack, 0)
-                        }
+            case W_OVER:
+                stack = append(stack, stack[top-1])
+                top += 1
 
-                    case W_GREATER:
-                        pop, stack = stack[top], stack[:top]
-                        top -= 1
-                        if stack[top] > pop {
-                            stack[top] = 1
-                        } else {
-                            stack[top] = 0
-                        }
+            case W_DROP:
+                stack = stack[:top]
+                top -= 1
 
-                    case W_LESS:
-                        pop, stack = stack[top], stack[:top]
-                        top -= 1
-                        if stack[top] < pop {
-                            stack[top] = 1
-                        } else {
-                            stack[top] = 0
-                        }
+            case W_NIP:
+                pop, stack = stack[top], stack[:top]
+                top -= 1
+                stack[top] = pop
 
-                    case W_NOT:
-                        if stack[top] == 0 {
-                            stack[top] = 1
-                        } else {
-                            stack[top] = 0
-                        }
+            case W_TUCK:
+                stack = append(stack, stack[top])
+                top += 1
+                stack[top], stack[top-1] = stack[top-1], stack[top]
 
-                    case W_AND:
-                        pop, stack = stack[top], stack[:top]
-                        top -= 1
-                        if pop != 0 && stack[top] != 0 {
-                            stack[top] = 1
-                        } else {
-                            stack[top] = 0
-                        }
+            case W_SWAP:
+                stack[top], stack[top-1] = stack[top-1], stack[top]
 
-                    case W_OR:
-                        pop, stack = stack[top], stack[:top]
-                        top -= 1
-                        if pop != 0 || stack[top] != 0 {
-                            stack[top] = 1
-                        } else {
-                            stack[top] = 0
-                        }
+            case W_ROT:
+                stack[top], stack[top-1], stack[top-2] = stack[top-2], stack[top], stack[top-1]
 
-                    case W_DUP:
-                        stack = append(stack, stack[top])
-                        top += 1
+            case W_HIDE:
+                stack[top], stack[top-1], stack[top-2] = stack[top-1], stack[top-2], stack[top]
 
-                    case W_DDUP:
-                        stack = append(stack, stack[top-1], stack[top])
-                        top += 2
+            case W_FIDDLE:
+                stack[top-1], stack[top-2] = stack[top-2], stack[top-1]
 
-                    case W_OVER:
-                        stack = append(stack, stack[top-1])
-                        top += 1
+            case W_DO:
+                /* ( limit start -- ) */
+                var limit, start float64
+                limit, start, stack = stack[top-1], stack[top], stack[:top-1]
+                top -= 2
+                if start < limit {
+                    loops = append(loops, LoopState{start, limit})
+                } else {
+                    // nothing to do, skip past the LOOP
+                    next = ins.jump
+                }
 
-                    case W_DROP:
-                        stack = stack[:top]
-                        top -= 1
+            case W_LOOP:
+                loop := &loops[len(loops)-1]
+                loop.index += 1
+                if loop.index < loop.limit {
+                    loop_count += 1
+                    if loop_count > LOOP_LIMIT {
+                        return output, stack, runtime_error(code_ptr, w_info.name, "more than %d LOOPs in one run", LOOP_LIMIT)
+                    }
+                    next = ins.jump
+                } else {
+                    loops = loops[:len(loops)-1]
+                }
 
-                    case W_NIP:
-                        pop, stack = stack[top], stack[:top]
-                        top -= 1
-                        stack[top] = pop
+            case W_I:
+                if len(loops) < 1 {
+                    return output, stack, runtime_error(code_ptr, w_info.name, "I outside DO...LOOP")
+                }
+                stack = append(stack, loops[len(loops)-1].index)
+                top += 1
 
-                    case W_TUCK:
-                        stack = append(stack, stack[top])
-                        top += 1
-                        stack[top], stack[top-1] = stack[top-1], stack[top]
+            case W_J:
+                if len(loops) < 2 {
+                    return output, stack, runtime_error(code_ptr, w_info.name, "J outside nested DO...LOOP")
+                }
+                stack = append(stack, loops[len(loops)-2].index)
+                top += 1
 
-                    case W_SWAP:
-                        stack[top], stack[top-1] = stack[top-1], stack[top]
+            /* Useful words */
 
-                    case W_ROT:
-                        stack[top], stack[top-1], stack[top-2] = stack[top-2], stack[top], stack[top-1]
+            case W_MAX:
+                pop, stack = stack[top], stack[:top]
+                top -= 1
+                stack[top] = math.Max(pop,stack[top])
 
-                    case W_HIDE:
-                        stack[top], stack[top-1], stack[top-2] = stack[top-1], stack[top-2], stack[top]
+            case W_MIN:
+                pop, stack = stack[top], stack[:top]
+                top -= 1
+                stack[top] = math.Min(pop,stack[top])
 
-                    case W_FIDDLE:
-                        stack[top-1], stack[top-2] = stack[top-2], stack[top-1]
+            /* musical words */
 
-                    case W_LOOP:
-                        // TODO
+            case W_HZ:
+                stack[top] *= m.config.Loop
 
-                    /* Useful words */
+            case W_BPM:
+                stack[top] *= m.config.Loop / m.tempo / math.Pi
 
-                    case W_MAX:
-                        pop, stack = stack[top], stack[:top]
-                        top -= 1
-                        stack[top] = math.Max(pop,stack[top])
+            case W_S:
+                stack[top] /= m.config.Loop / (2*math.Pi)
 
-                    case W_MIN:
-                        pop, stack = stack[top], stack[:top]
-                        top -= 1
-                        stack[top] = math.Min(pop,stack[top])
+            case W_T:
+                stack = append(stack, phase)
+                top += 1
 
-                    /* musical words */
+            case W_GLIDE, W_LAG:
+                /* ( value time -- smoothed ) */
+                samples := stack[top] * m.config.Loop / (2*math.Pi) * m.config.SampleRate
+                stack = stack[:top]
+                top -= 1
+                if w == W_GLIDE {
+                    stack[top] = m.glide(iter, ins.value, block, stack[top], samples)
+                } else {
+                    stack[top] = m.lag(iter, ins.value, block, stack[top], samples)
+                }
 
-                    case W_HZ:
-                        stack[top] *= HZ
+            case W_PHASE:
+                /* ( freq -- angle ) */
+                stack[top] = m.accumulate(iter, ins.value, 0, block, stack[top])
+
+            case W_BEAT:
+                stack = append(stack, m.beat(iter))
+                top += 1
+
+            case W_TEMPO:
+                stack = append(stack, m.tempo)
+                top += 1
+
+            case W_LIVE:
+                stack = append(stack, LIVE_TRACK)
+                top += 1
+
+            case W_VOICES:
+                /* ( track -- sum ) running the patch ( freq velocity gate age -- signal ) for each voice */
+                pop, stack = stack[top], stack[:top]
+                top -= 1
+                state := VoiceState{int(ins.value), int(pop), -1, 0}
+                state.voice = m.next_voice(state.track, -1, now)
+                if state.voice < 0 {
+                    stack = append(stack, 0)
+                    top += 1
+                    next = ins.jump
+                } else {
+                    voices = append(voices, state)
+                    stack = m.voice_args(stack, state.track, state.voice, now)
+                    top += 4
+                    block = 1 + state.site * m.config.Polyphony + state.voice
+                }
 
-                    case W_BPM:
-                        stack[top] *= BPM
+            case W_END_VOICES:
+                state := &voices[len(voices)-1]
+                pop, stack = stack[top], stack[:top]
+                top -= 1
+                state.sum += pop
+                state.voice = m.next_voice(state.track, state.voice, now)
+                if state.voice >= 0 {
+                    stack = m.voice_args(stack, state.track, state.voice, now)
+                    top += 4
+                    block = 1 + state.site * m.config.Polyphony + state.voice
+                    next = ins.jump
+                } else {
+                    stack = append(stack, state.sum)
+                    top += 1
+                    voices = voices[:len(voices)-1]
+                    block = 0
+                    if len(voices) > 0 {
+                        outer := voices[len(voices)-1]
+                        block = 1 + outer.site * m.config.Polyphony + outer.voice
+                    }
+                }
 
-                    case W_S:
-                        stack[top] /= BPM*60
+            case W_NOTE, W_VELOCITY, W_GATE, W_AGE:
+                /* ( track voice -- value ) for the last note the voice played */
+                var track, voice float64
+                track, voice, stack = stack[top-1], stack[top], stack[:top]
+                top -= 1
+                note, held := m.playing(int(track), int(voice), now)
+                switch {
+                    case note.Velocity == 0:
+                        stack[top] = 0 // nothing played yet
+                    case w == W_NOTE:
+                        stack[top] = pitch(m.tuned(), note.Key - 69) * m.config.Loop
+                    case w == W_VELOCITY:
+                        stack[top] = float64(note.Velocity) / 127
+                    case w == W_GATE && held:
+                        stack[top] = 1
+                    case w == W_GATE:
+                        stack[top] = 0
+                    case w == W_AGE:
+                        stack[top] = (now - note.Start) * 2 * math.Pi / m.config.Loop
+                }
 
-                    case W_T:
-                        stack = append(stack, phase)
-                        top += 1
+            case W_ON:
+                /* (time, length, base -- age, on (if on) OR off (if off) */
+                var sched, dur, now float64
+                sched, dur, now, stack = stack[top-2], stack[top-1], stack[top], stack[:top-1]
+                age := now - sched
+                if age > 0 && age < dur {
+                    stack[top-2] = age
+                    stack = append(stack, 1)
+                    top -= 1
+                } else {
+                    stack[top-2] = 0
+                    top -= 2
+                }
 
-                    case W_ON:
-                        /* (time, length, base -- age, on (if on) OR off (if off) */
-                        var sched, dur, now float64
-                        sched, dur, now, stack = stack[top-2], stack[top-1], stack[top], stack[:top-1]
-                        age := now - sched
-                        if age > 0 && age < dur {
-                            stack[top-2] = age
-                            stack = append(stack, 1)
-                            top -= 1
-                        } else {
-                            stack[top-2] = 0
-                            top -= 2
-                        }
+            case W_ADSR, W_AR:
+                /* ( age gate attack decay sustain release -- level ) or ( age gate attack release -- level ) */
+                base := top - w_info.needs + 1
+                decay, sustain := 0.0, 1.0
+                if w == W_ADSR {
+                    decay, sustain = stack[base+3], stack[base+4]
+                }
+                level := m.envelope(iter, ins.value, block, stack[base], stack[base+1], stack[base+2], decay, sustain, stack[top])
+                stack = stack[:base+1]
+                top = base
+                stack[top] = level
+
+            case W_LPF, W_HPF, W_BPF, W_NOTCH, W_PEAK, W_LOSHELF, W_HISHELF:
+                /* ( in cutoff q -- out ) or, for PEAK and the shelves, ( in cutoff q gain -- out ) */
+                base := top - w_info.needs + 1
+                gain := 0.0
+                if w_info.needs == 4 {
+                    gain = stack[top]
+                }
+                if stack[base+2] <= 0 {
+                    return output, stack, runtime_error(code_ptr, w_info.name, "Q must be more than 0, got %v", stack[base+2])
+                }
+                out := m.biquad(iter, ins.value, block, w, stack[base], stack[base+1], stack[base+2], gain)
+                stack = stack[:base+1]
+                top = base
+                stack[top] = out
+
+            case W_DELAY, W_ECHO, W_COMB, W_ALLPASS:
+                /* ( in time -- out ) or ( in time amount -- out ) */
+                base := top - w_info.needs + 1
+                amount := 0.0
+                if w_info.needs == 3 {
+                    amount = stack[top]
+                }
+                line := m.delay_line(ins.value, block)
+                back, msg := m.delay_samples(stack[base+1], line)
+                if msg != "" {
+                    return output, stack, runtime_error(code_ptr, w_info.name, "%s (%v seconds)", msg, m.config.MaxDelay)
+                }
+                started := int64(-1)
+                if len(voices) > 0 {
+                    // only what this voice's note has played
+                    voice := voices[len(voices)-1]
+                    note, _ := m.playing(voice.track, voice.voice, now)
+                    started = int64(math.Round(note.Start * m.config.SampleRate))
+                }
+                out := m.delay(iter, line, w, stack[base], back, amount, started)
+                stack = stack[:base+1]
+                top = base
+                stack[top] = out
+
+            case W_PREWARP:
+                /* This value is useful for making filters with true cutoff frequency.
+                   Use DELTA to get the previous sample.
+                   Note effective sample rate == sample rate / workers,
+                   because DELTA depends on the number of workers
+                */
+
+                stack[top] = math.Tan(math.Pi * stack[top] * float64(m.config.Workers) / m.config.SampleRate)
+
+            /* intervals */
+
+            case W_SHARP:
+                stack[top] *= m.semitone
+            case W_FLAT:
+                stack[top] /= m.semitone
+            case W_HIGH:
+                stack[top] *= 2
+            case W_LOW:
+                stack[top] /= 2
+
+            /* oscillators */
+
+            case W_SIN:
+                stack[top] = math.Sin(stack[top])
+
+            case W_SAW:
+                _, frac := math.Modf(stack[top])
+                stack[top] = math.Floor(frac*4) / 4
+                //stack[top] = 1 - math.Mod(stack[top] * 2, 2)
+
+            case W_TR:
+                frac := math.Mod(stack[top] / math.Pi, 2)
+                if frac < 1 {
+                    stack[top] = frac * 2 - 1
+                } else {
+                    stack[top] = 3 - frac * 2
+                }
 
-                    case W_PREWARP:
-                        /* This value is useful for making filters with true cutoff frequency.
-                           Use DELTA to get the previous sample.
-                           Note effective sample rate == sample rate / workers,
-                           because DELTA depends on the number of workers
-                        */
+            case W_PULSE: // width angle -- value
+                width, frac := stack[top-1], math.Mod(stack[top] / math.Pi, 2)
+                stack = stack[:top]
+                top -= 1
+                if frac < width {
+                    stack[top] = 1
+                } else {
+                    stack[top] = -1
+                }
 
-                        stack[top] = math.Tan(math.Pi * stack[top] * float64(m.workers) / m.sample_rate)
+            case W_SQ:
+                frac := math.Mod(stack[top] / math.Pi, 2)
+                if frac < 1 {
+                    stack[top] = 1
+                } else {
+                    stack[top] = -1
+                }
 
-                    /* intervals */
+            case W_NOISE:
+                stack = append(stack, white_noise(seed, iter, noise_site(code_ptr, block)))
+                top += 1
 
-                    case W_SHARP:
-                        stack[top] *= SEMITONE
-                    case W_FLAT:
-                        stack[top] /= SEMITONE
-                    case W_HIGH:
-                        stack[top] *= 2
-                    case W_LOW:
-                        stack[top] /= 2
+            case W_PINK:
+                stack = append(stack, pink_noise(seed, iter, noise_site(code_ptr, block)))
+                top += 1
 
-                    /* oscillators */
+            case W_BROWN:
+                stack = append(stack, m.brown_noise(iter, ins.value, block, white_noise(seed, iter, noise_site(code_ptr, block))))
+                top += 1
 
-                    case W_SIN:
-                        stack[top] = math.Sin(stack[top])
+            case W_SH:
+                stack[top] = sample_hold(seed, stack[top], noise_site(code_ptr, block))
 
-                    case W_SAW:
-                        _, frac := math.Modf(stack[top])
-                        stack[top] = math.Floor(frac*4) / 4
-                        //stack[top] = 1 - math.Mod(stack[top] * 2, 2)
+            case W_SEED:
+                seed = int64(stack[top])
+                stack = stack[:top]
+                top -= 1
 
-                    case W_TR:
-                        frac := math.Mod(stack[top] / math.Pi, 2)
-                        if frac < 1 {
-                            stack[top] = frac * 2 - 1
-                        } else {
-                            stack[top] = 3 - frac * 2
-                        }
+            case W_OP, W_OPFB:
+                /* ( freq mod -- out ) or ( freq mod feedback -- out ) */
+                base := top - w_info.needs + 1
+                feedback := 0.0
+                if w == W_OPFB {
+                    feedback = stack[top]
+                }
+                out := m.operator(iter, ins.value, block, stack[base], stack[base+1], feedback)
+                stack = stack[:base+1]
+                top = base
+                stack[top] = out
+
+            case W_PLAY, W_LOOPED, W_WAVE:
+                /* ( table age rate -- signal ) or ( table angle -- signal ) */
+                base := top - w_info.needs + 1
+                id := int(stack[base])
+                if float64(id) != stack[base] || id < 0 || id >= len(m.tables) {
+                    return output, stack, runtime_error(code_ptr, w_info.name, "no sample %v", stack[base])
+                }
+                table := m.tables[id]
+                if w == W_WAVE {
+                    stack[base] = table.at(cycle(stack[top]) * float64(len(table.Samples)), true)
+                } else {
+                    seconds := stack[base+1] * m.config.Loop / (2*math.Pi)
+                    stack[base] = table.at(seconds * stack[top] * table.SampleRate, w == W_LOOPED)
+                }
+                stack = stack[:base+1]
+                top = base
 
-                    case W_PULSE: // width angle -- value
-                        width, frac := stack[top-1], math.Mod(stack[top] / math.Pi, 2)
-                        stack = stack[:top]
-                        top -= 1
-                        if frac < width {
-                            stack[top] = 1
-                        } else {
-                            stack[top] = -1
-                        }
+            case W_RAMP:
+                stack[top] = ramp(cycle(stack[top]))
 
-                    case W_SQ:
-                        frac := math.Mod(stack[top] / math.Pi, 2)
-                        if frac < 1 {
-                            stack[top] = 1
-                        } else {
-                            stack[top] = -1
-                        }
+            case W_BLSAW, W_BLSQ, W_BLTR: // freq angle -- value
+                t, dt := cycle(stack[top]), math.Min(math.Abs(stack[top-1] * m.step), 0.5)
+                stack = stack[:top]
+                top -= 1
+                switch w {
+                    case W_BLSAW:
+                        stack[top] = bl_saw(t, dt)
+                    case W_BLSQ:
+                        stack[top] = bl_pulse(t, dt, 0.5)
+                    case W_BLTR:
+                        stack[top] = bl_tr(t, dt)
+                }
 
-                    case W_NOISE:
-                        stack = append(stack, rand.Float64())
-                        top += 1
+            case W_BLPULSE: // width freq angle -- value
+                t, dt := cycle(stack[top]), math.Min(math.Abs(stack[top-1] * m.step), 0.5)
+                duty := math.Max(0, math.Min(stack[top-2] / 2, 1))
+                stack = stack[:top-1]
+                top -= 2
+                stack[top] = bl_pulse(t, dt, duty)
 
-                    /* Words removed at compile time */
+            /* Words removed at compile time */
 
-                    case W_CONSTANT, W_KEEP:
-                        return output, stack, fmt.Errorf("Runtime error: %s not pre-evaluated", w_info.name)
+            case W_CONSTANT, W_KEEP:
+                return output, stack, runtime_error(code_ptr, w_info.name, "%s not pre-evaluated", w_info.name)
 
 
-                    default:
-                        return output, stack, fmt.Errorf("Runtime error: unknown opcode %v", w)
-                }
+            default:
+                return output, stack, runtime_error(code_ptr, w_info.name, "unknown opcode %v", w)
         }
 
-        if DEBUG == true {
-            fmt.Println(w_info.name,": stack=",stack,top,"mode=",mode_breadcrumb,mode,"choose=",choose_value,"out=",output)
+        if m.config.Debug {
+            m.config.Logger.Println(w_info.name,": stack=",stack,top,"loops=",loops,"out=",output)
         }
 
-        code_ptr += 1
-        w = code[code_ptr]
+        code_ptr = next
     }
-    if DEBUG == true {
-        fmt.Println("<<",stack,"out",output)
+    if m.config.Debug {
+        m.config.Logger.Println("<<",stack,"out",output)
     }
 
     return output, stack, err
@@ -0,0 +1,72 @@
+package d4
+
+import "math"
+
+/* How far through its cycle an oscillator at angle is, from 0 to 1 */
+
+func cycle( angle float64 ) float64 {
+    t := math.Mod(angle / (2*math.Pi), 1)
+    if t < 0 {
+        t += 1
+    }
+    return t
+}
+
+/* What to take away near a jump from 1 down to -1 at t=0, to band-limit it.
+   dt is how far through the cycle each sample moves */
+
+func poly_blep( t float64, dt float64 ) float64 {
+    switch {
+        case t < dt:
+            t /= dt
+            return t + t - t*t - 1
+        case t > 1 - dt:
+            t = (t - 1) / dt
+            return t*t + t + t + 1
+    }
+    return 0
+}
+
+/* Likewise for a corner at t=0, to round it off */
+
+func poly_blamp( t float64, dt float64 ) float64 {
+    switch {
+        case t < dt:
+            t = t / dt - 1
+            return -t*t*t / 3
+        case t > 1 - dt:
+            t = (t - 1) / dt + 1
+            return t*t*t / 3
+    }
+    return 0
+}
+
+/* A rising sawtooth from -1 to 1 */
+
+func ramp( t float64 ) float64 {
+    return 2*t - 1
+}
+
+func bl_saw( t float64, dt float64 ) float64 {
+    return ramp(t) - poly_blep(t, dt)
+}
+
+/* 1 for the first duty of the cycle, then -1 */
+
+func bl_pulse( t float64, dt float64, duty float64 ) float64 {
+    out := -1.0
+    if t < duty {
+        out = 1
+    }
+    return out + poly_blep(t, dt) - poly_blep(cycle((t - duty) * 2*math.Pi), dt)
+}
+
+/* Rising from -1 at t=0 to 1 at t=0.5 and back, like TR */
+
+func bl_tr( t float64, dt float64 ) float64 {
+    out := 4*t - 1
+    if t >= 0.5 {
+        out = 3 - 4*t
+    }
+    return out + 4 * dt * (poly_blamp(t, dt) - poly_blamp(cycle((t - 0.5) * 2*math.Pi), dt))
+}
@@ -1,6 +1,9 @@
 package d4
 
 import (
+    "bufio"
+    "fmt"
+    "io"
     "unicode"
     "unicode/utf8"
 )
@@ -9,6 +12,71 @@ const R_LETTER = 0
 const R_DIGIT = 1
 const R_OTHER = 2
 
+/* Where a word was found. Line and Col count from 1, Line is 0 if the position isn't known */
+type Pos struct {
+    File string
+    Line int
+    Col int
+}
+
+func (p Pos) String() string {
+    if p.Line == 0 {
+        return p.File
+    }
+    if p.File == "" {
+        return fmt.Sprintf("%d:%d", p.Line, p.Col)
+    }
+    return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Col)
+}
+
+/* The position after reading data, starting from p */
+func (p Pos) advance(data []byte) Pos {
+    for len(data) > 0 {
+        r, width := utf8.DecodeRune(data)
+        if r == '\n' {
+            p.Line += 1
+            p.Col = 1
+        } else {
+            p.Col += 1
+        }
+        data = data[width:]
+    }
+    return p
+}
+
+type Token struct {
+    word string
+    pos Pos
+}
+
+/* A bufio.Scanner splitting with ScanForthWords, which also keeps track of
+   the position of each word */
+type WordScanner struct {
+    *bufio.Scanner
+    at Pos  // start of the data not yet consumed
+    pos Pos // start of the last word scanned
+}
+
+func NewWordScanner(in io.Reader, file string) *WordScanner {
+    s := &WordScanner{bufio.NewScanner(in), Pos{file, 1, 1}, Pos{file, 1, 1}}
+    s.Split(s.split)
+    return s
+}
+
+func (s *WordScanner) Pos() Pos {
+    return s.pos
+}
+
+func (s *WordScanner) split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+    advance, token, err = ScanForthWords(data, atEOF)
+    if token != nil {
+        // the word is always at the end of what was consumed
+        s.pos = s.at.advance(data[:advance-len(token)])
+    }
+    s.at = s.at.advance(data[:advance])
+    return advance, token, err
+}
+
 func ScanForthWords(data []byte, atEOF bool) (advance int, token []byte, err error) {
     // Skip leading spaces.
     start := 0
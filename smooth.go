@@ -0,0 +1,74 @@
+package d4
+
+import "math"
+
+/* Slots GLIDE keeps between samples: its value, where it's gliding from and to,
+   and the iteration it set off */
+const GLIDE_STATE = 4
+
+const G_LEVEL = 0
+const G_FROM = 1
+const G_TO = 2
+const G_START = 3
+
+/* LAG keeps its value */
+const LAG_STATE = 1
+
+/* One sample of moving from `from` towards `to`, with a time constant of `samples` */
+
+func lag_step( from float64, to float64, samples float64 ) float64 {
+    return to + (from - to) * math.Exp(-1 / samples)
+}
+
+/* Whether controls glide to new values, so each sample depends on the last */
+
+func (m *OpcodeMachine) smoothed() bool {
+    return m.config.Smoothing > 0 && len(m.control_keys) > 0
+}
+
+/* Follow value in a straight line, taking `samples` to get to each new value
+   from wherever it had got to. It starts at the first value it's given */
+
+func (m *OpcodeMachine) glide( iter int64, addr float64, block int, value float64, samples float64 ) float64 {
+    if !m.has_state(iter, addr, G_LEVEL, block) {
+        m.keep_state(iter, addr, G_LEVEL, block, value)
+        m.keep_state(iter, addr, G_FROM, block, value)
+        m.keep_state(iter, addr, G_TO, block, value)
+        m.keep_state(iter, addr, G_START, block, float64(iter))
+        return value
+    }
+
+    level := m.state(iter, addr, G_LEVEL, block)
+    from := m.state(iter, addr, G_FROM, block)
+    to := m.state(iter, addr, G_TO, block)
+    start := m.state(iter, addr, G_START, block)
+
+    if value != to {
+        from, to, start = level, value, float64(iter)
+    }
+
+    level = to
+    elapsed := float64(iter) - start
+    if elapsed < samples {
+        level = from + (to - from) * elapsed / samples
+    }
+
+    m.keep_state(iter, addr, G_LEVEL, block, level)
+    m.keep_state(iter, addr, G_FROM, block, from)
+    m.keep_state(iter, addr, G_TO, block, to)
+    m.keep_state(iter, addr, G_START, block, start)
+    return level
+}
+
+/* Follow value exponentially, with a time constant of `samples`, so it gets
+   about two thirds of the way to each new value in that time. It starts at the
+   first value it's given */
+
+func (m *OpcodeMachine) lag( iter int64, addr float64, block int, value float64, samples float64 ) float64 {
+    level := value
+    if m.has_state(iter, addr, 0, block) && samples > 0 {
+        level = lag_step(m.state(iter, addr, 0, block), value, samples)
+    }
+    m.keep_state(iter, addr, 0, block, level)
+    return level
+}
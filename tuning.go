@@ -0,0 +1,188 @@
+package d4
+
+import (
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+)
+
+/* The frequency of A4, which note names are tuned from */
+const CONCERT_A = 440
+
+/* How notes are spread out. Steps count from A4, and Steps() of them make an octave
+   (or whatever the tuning repeats at). Note names are mapped onto the nearest step */
+type Tuning interface {
+    Ratio(step int) float64
+    Steps() int
+}
+
+/* A tuning made of the ratio of each step above the first, ending with the period
+   it repeats at. This is what Scala files describe */
+type scale struct {
+    ratios []float64
+}
+
+func (s scale) Ratio(step int) float64 {
+    n := len(s.ratios)
+    period, index := step / n, step % n
+    if index < 0 {
+        period, index = period - 1, index + n
+    }
+    r := 1.0
+    if index > 0 {
+        r = s.ratios[index-1]
+    }
+    return r * math.Pow(s.ratios[n-1], float64(period))
+}
+
+func (s scale) Steps() int {
+    return len(s.ratios)
+}
+
+/* n equal divisions of the octave. 12 is the usual equal temperament */
+
+func EqualTemperament(n int) Tuning {
+    ratios := make([]float64, n)
+    for i := range ratios {
+        ratios[i] = math.Pow(2, float64(i+1) / float64(n))
+    }
+    ratios[n-1] = 2
+    return scale{ratios}
+}
+
+/* 5-limit just intonation, in A */
+
+func JustIntonation() Tuning {
+    return scale{[]float64{ 16.0/15, 9.0/8, 6.0/5, 5.0/4, 4.0/3, 45.0/32, 3.0/2, 8.0/5, 5.0/3, 9.0/5, 15.0/8, 2 }}
+}
+
+/* Pythagorean tuning, stacking pure fifths from A */
+
+func Pythagorean() Tuning {
+    return scale{[]float64{ 256.0/243, 9.0/8, 32.0/27, 81.0/64, 4.0/3, 729.0/512, 3.0/2, 128.0/81, 27.0/16, 16.0/9, 243.0/128, 2 }}
+}
+
+/* Read a tuning from the text of a Scala .scl file: a description, the number
+   of pitches, then each pitch in cents (if it has a .) or as a ratio */
+
+func ParseScala(text string) (Tuning, error) {
+    lines := []string{}
+    described := false
+    for _, line := range strings.Split(text, "\n") {
+        line = strings.TrimSpace(line)
+        if strings.HasPrefix(line, "!") {
+            continue
+        }
+        if !described {
+            // the description may be empty, but nothing after it can be
+            described = true
+        } else if line == "" {
+            continue
+        }
+        lines = append(lines, line)
+    }
+
+    if len(lines) < 2 {
+        return nil, fmt.Errorf("Scala error: no pitch count")
+    }
+
+    n, err := strconv.Atoi(strings.Fields(lines[1])[0])
+    if err != nil || n < 1 {
+        return nil, fmt.Errorf("Scala error: bad pitch count %q", lines[1])
+    }
+    if len(lines) < n+2 {
+        return nil, fmt.Errorf("Scala error: %d pitches promised, %d found", n, len(lines)-2)
+    }
+
+    ratios := make([]float64, n)
+    for i, line := range lines[2:n+2] {
+        pitch := strings.Fields(line)[0]
+        var r float64
+        if strings.Contains(pitch, ".") {
+            cents, err := strconv.ParseFloat(pitch, 64)
+            if err != nil {
+                return nil, fmt.Errorf("Scala error: bad pitch %q", line)
+            }
+            r = math.Pow(2, cents / 1200)
+        } else {
+            num, den, found := strings.Cut(pitch, "/")
+            a, err := strconv.ParseFloat(num, 64)
+            b := 1.0
+            if err == nil && found {
+                b, err = strconv.ParseFloat(den, 64)
+            }
+            if err != nil || a <= 0 || b <= 0 {
+                return nil, fmt.Errorf("Scala error: bad pitch %q", line)
+            }
+            r = a / b
+        }
+        ratios[i] = r
+    }
+
+    return scale{ratios}, nil
+}
+
+/* The ratio SHARP and FLAT move by: the step nearest a twelfth of the period */
+
+func semitone(t Tuning) float64 {
+    step := int(math.Round(float64(t.Steps()) / 12))
+    if step < 1 {
+        step = 1
+    }
+    return t.Ratio(step) / t.Ratio(0)
+}
+
+/* Semitones above A in the same octave for each note letter */
+var NOTE_LETTERS = map[byte]int{ 'C': -9, 'D': -7, 'E': -5, 'F': -4, 'G': -2, 'A': 0, 'B': 2 }
+
+/* If the tokens from defn[i] on spell a note name like A4, C#3 or Bb2 (which scan
+   as separate words, so must be next to each other), return its frequency and how
+   many tokens it took up */
+
+func note( t Tuning, defn []Token, i int ) (float64, int, bool) {
+    word := defn[i].word
+    letter, ok := NOTE_LETTERS[word[0]]
+    if !ok || len(word) > 2 || (len(word) == 2 && word[1] != 'B') {
+        return 0, 0, false
+    }
+    semitones := letter
+    if len(word) == 2 {
+        semitones -= 1
+    }
+
+    used := 1
+    next_to := func(j int) bool {
+        return j < len(defn) && defn[j].pos.Line != 0 && defn[j].pos.File == defn[j-1].pos.File &&
+               defn[j].pos.Line == defn[j-1].pos.Line && defn[j].pos.Col == defn[j-1].pos.Col + len([]rune(defn[j-1].word))
+    }
+
+    if next_to(i+used) && len(word) == 1 {
+        switch defn[i+used].word {
+            case "#", "♯":
+                semitones += 1
+                used += 1
+            case "♭":
+                semitones -= 1
+                used += 1
+        }
+    }
+
+    if !next_to(i+used) {
+        return 0, 0, false
+    }
+    octave, err := strconv.Atoi(defn[i+used].word)
+    if err != nil || strings.ContainsAny(defn[i+used].word, "+-") {
+        return 0, 0, false
+    }
+    semitones += (octave - 4) * 12
+
+    return pitch(t, semitones), used + 1, true
+}
+
+/* The frequency of the note some semitones from A4, on the nearest step of the tuning */
+
+func pitch( t Tuning, semitones int ) float64 {
+    step := int(math.Round(float64(semitones * t.Steps()) / 12))
+    return CONCERT_A * t.Ratio(step)
+}
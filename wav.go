@@ -0,0 +1,144 @@
+package d4
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "math"
+)
+
+const WAV_PCM = 1
+const WAV_FLOAT = 3
+const WAV_EXTENSIBLE = 0xfffe
+
+/* A sound loaded with SAMPLE, mixed down to one channel */
+type Table struct {
+    Samples []float64 // from -1 to 1
+    SampleRate float64
+}
+
+/* Read a WAV file of 8, 16, 24 or 32 bit PCM, or 32 or 64 bit float */
+
+func ReadWAV(in io.Reader) (*Table, error) {
+    data, err := io.ReadAll(in)
+    if err != nil {
+        return nil, err
+    }
+
+    if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+        return nil, fmt.Errorf("WAV error: not a WAV file")
+    }
+    r := bytes.NewReader(data[12:])
+
+    var format, channels, bits int
+    var rate float64
+    for {
+        var header [8]byte
+        _, err := io.ReadFull(r, header[:])
+        if err != nil {
+            return nil, fmt.Errorf("WAV error: no data")
+        }
+        length := binary.LittleEndian.Uint32(header[4:])
+        if int64(length) > int64(r.Len()) {
+            return nil, fmt.Errorf("WAV error: %s chunk of %d bytes, but only %d left", header[:4], length, r.Len())
+        }
+        chunk := make([]byte, length)
+        _, err = io.ReadFull(r, chunk)
+        if err != nil {
+            return nil, fmt.Errorf("WAV error: %s chunk: %v", header[:4], err)
+        }
+        if len(chunk) % 2 == 1 {
+            r.ReadByte() // chunks are padded to an even length
+        }
+
+        switch string(header[:4]) {
+            case "fmt ":
+                if len(chunk) < 16 {
+                    return nil, fmt.Errorf("WAV error: fmt chunk too short")
+                }
+                format = int(binary.LittleEndian.Uint16(chunk[0:2]))
+                channels = int(binary.LittleEndian.Uint16(chunk[2:4]))
+                rate = float64(binary.LittleEndian.Uint32(chunk[4:8]))
+                bits = int(binary.LittleEndian.Uint16(chunk[14:16]))
+                if format == WAV_EXTENSIBLE && len(chunk) >= 26 {
+                    format = int(binary.LittleEndian.Uint16(chunk[24:26]))
+                }
+
+            case "data":
+                if channels < 1 {
+                    return nil, fmt.Errorf("WAV error: data before fmt")
+                }
+                samples, err := wav_samples(chunk, format, channels, bits)
+                if err != nil {
+                    return nil, err
+                }
+                return &Table{samples, rate}, nil
+        }
+    }
+}
+
+/* The frames in data, each channel's sample added up and divided by the number of channels */
+
+func wav_samples( data []byte, format int, channels int, bits int ) ([]float64, error) {
+    size := bits / 8
+    var sample func(b []byte) float64
+
+    switch {
+        case format == WAV_PCM && bits == 8:
+            sample = func(b []byte) float64 { return (float64(b[0]) - 128) / 128 }
+        case format == WAV_PCM && bits == 16:
+            sample = func(b []byte) float64 { return float64(int16(binary.LittleEndian.Uint16(b))) / (1 << 15) }
+        case format == WAV_PCM && bits == 24:
+            sample = func(b []byte) float64 { return float64(int32(uint32(b[0]) << 8 | uint32(b[1]) << 16 | uint32(b[2]) << 24) >> 8) / (1 << 23) }
+        case format == WAV_PCM && bits == 32:
+            sample = func(b []byte) float64 { return float64(int32(binary.LittleEndian.Uint32(b))) / (1 << 31) }
+        case format == WAV_FLOAT && bits == 32:
+            sample = func(b []byte) float64 { return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))) }
+        case format == WAV_FLOAT && bits == 64:
+            sample = func(b []byte) float64 { return math.Float64frombits(binary.LittleEndian.Uint64(b)) }
+        default:
+            return nil, fmt.Errorf("WAV error: can't read format %d with %d bits", format, bits)
+    }
+
+    frame := size * channels
+    samples := make([]float64, len(data) / frame)
+    for i := range samples {
+        sum := 0.0
+        for c := 0; c < channels; c++ {
+            sum += sample(data[i*frame + c*size:])
+        }
+        samples[i] = sum / float64(channels)
+    }
+    return samples, nil
+}
+
+/* The table's value at index, between samples if index isn't whole. Outside the table
+   it's 0, unless looped, when the table goes round again */
+
+func (t *Table) at( index float64, looped bool ) float64 {
+    n := len(t.Samples)
+    if n == 0 {
+        return 0
+    }
+    if looped {
+        index = math.Mod(index, float64(n))
+        if index < 0 {
+            index += float64(n)
+        }
+    }
+
+    whole := math.Floor(index)
+    i := int(whole)
+    if i < 0 || i >= n {
+        return 0
+    }
+    next := 0.0
+    if i+1 < n {
+        next = t.Samples[i+1]
+    } else if looped {
+        next = t.Samples[0]
+    }
+    frac := index - whole
+    return t.Samples[i] * (1 - frac) + next * frac
+}
@@ -2,9 +2,10 @@ package d4
 
 type Word struct {
     name string
-    opcode float64    // so we can stick everything in a big array
+    opcode int        // so we can stick everything in a big array
     t_dependent bool
     needs int         // how many values must be on the stack
+    state int         // state slots each use needs, for words which remember things between samples
 }
 
 const W_NOOP = 0xff
@@ -12,6 +13,10 @@ const W_NUMBER = 0xf0 // used to signal the next item is a number not an opcode
 const W_OUTPUT = 0xf1
 const W_CLIP = 0xf2
 const W_DUP_OUTPUT = 0xf3
+const W_CHANNEL = 0xf4
+const W_LEFT = 0xf5
+const W_RIGHT = 0xf6
+const W_PAN = 0xf7
 
 const W_EOF = 0x00 // stop
 
@@ -22,12 +27,15 @@ const W_END_DEF = 0xe3
 const W_IF = 0xe4
 const W_THEN = 0xe5
 const W_ELSE = 0xe6
+const W_DO = 0xe7
+const W_I = 0xe8
 const W_LOOP = 0xe9
 const W_CHOOSE = 0xea
 const W_FROM = 0xeb
 const W_CHOOSE_SEP = 0xec
 const W_BEGIN_LITERAL = 0xed
 const W_END_LITERAL = 0xee
+const W_J = 0xef
 
 const W_CONSTANT = 0xd0
 const W_VARIABLE = 0xd1
@@ -71,6 +79,8 @@ const W_FIDDLE = 0x29
 const W_HZ = 0x30
 const W_BPM = 0x31
 const W_S = 0x32
+const W_BEAT = 0x33
+const W_TEMPO = 0x34
 
 const W_FLAT = 0x40
 const W_SHARP = 0x41
@@ -78,6 +88,34 @@ const W_HIGH = 0x42
 const W_LOW = 0x43
 
 const W_ON = 0x50
+const W_ADSR = 0x51
+const W_AR = 0x52
+
+const W_GLIDE = 0x58
+const W_LAG = 0x59
+
+const W_LPF = 0xa0
+const W_HPF = 0xa1
+const W_BPF = 0xa2
+const W_NOTCH = 0xa3
+const W_PEAK = 0xa4
+const W_LOSHELF = 0xa5
+const W_HISHELF = 0xa6
+
+const W_DELAY = 0xb0
+const W_ECHO = 0xb1
+const W_COMB = 0xb2
+const W_ALLPASS = 0xb3
+
+const W_NOTE = 0x90
+const W_VELOCITY = 0x91
+const W_GATE = 0x92
+const W_AGE = 0x93
+const W_LIVE = 0x94
+const W_VOICES = 0x95
+const W_END_VOICES = 0x96
+
+const W_PHASE = 0x70
 
 const W_T = 0x80
 const W_SIN = 0x81
@@ -87,96 +125,174 @@ const W_PULSE = 0x84
 const W_SQ = 0x85
 const W_PREWARP = 0x86
 const W_NOISE = 0x87
+const W_RAMP = 0x88
+const W_BLSAW = 0x89
+const W_BLSQ = 0x8a
+const W_BLPULSE = 0x8b
+const W_BLTR = 0x8c
+const W_PINK = 0x8d
+const W_BROWN = 0x8e
+const W_SH = 0x8f
+
+const W_SEED = 0x60
+
+const W_PLAY = 0xc0
+const W_LOOPED = 0xc1
+const W_WAVE = 0xc2
+
+const W_OP = 0xc8
+const W_OPFB = 0xc9
 
 var WORDS = map[string]Word{
 
-    "NOOP":     Word{ "NOOP", W_NOOP, false, 0 },
-    "LITERAL":  Word{ "NOOP", W_NOOP, false, 0 }, // merely to allow [ ] LITERAL to work like in forth
-    ".":        Word{ ".", W_OUTPUT, false, 1 },
-    "&":        Word{ "&", W_DUP_OUTPUT, false, 1 },
-    "CLIP":     Word{ "CLIP", W_CLIP,   false, 1 },
-
-    "(":        Word{ "(", W_BEGIN_COMMENT,  false, 0 },
-    ")":        Word{ ")", W_END_COMMENT,  false, 0 },
-    ":":        Word{ ":", W_BEGIN_DEF,  false, 0 },
-    ";":        Word{ ";", W_END_DEF,  false, 0 },
-    "IF":       Word{ "IF", W_IF,  false, 1 },
-    "THEN":     Word{ "THEN", W_THEN,  false, 0 },
-    "ELSE":     Word{ "ELSE", W_ELSE,  false, 0 },
-    "LOOP":     Word{ "LOOP", W_LOOP,  false, 0 },
-    "CHOOSE":   Word{ "CHOOSE", W_CHOOSE,  false, 0 },
-    "FROM":     Word{ "FROM", W_FROM,  false, 1 },
-    ",":        Word{ ",", W_CHOOSE_SEP, false, 0 },
-    "[":        Word{ "[", W_BEGIN_LITERAL,  false, 0 },
-    "]":        Word{ "]", W_END_LITERAL,  false, 0 },
-
-    "KEEP":     Word{ "KEEP", W_KEEP,  false, 1 },
-    "CONSTANT": Word{ "CONSTANT", W_CONSTANT,  false, 0 },
-    "CONTROL":  Word{ "CONSTANT", W_CONSTANT,  false, 0 }, // CONSTANTs are confusingly not constant, provide a synonym
-    "VARIABLE": Word{ "VARIABLE", W_VARIABLE,  false, 1 },
-    "@":        Word{ "PEEK", W_PEEK,  true, 1 },
-    "!":        Word{ "POKE", W_POKE,  true, 2 },
-    "OLD":      Word{ "OLD", W_OLD, true, 2 },
-    "DELTA":    Word{ "DELTA", W_DELTA, true, 1 },
-
-    "FALSE":    Word{ "FALSE", W_FALSE,    false, 0 },
-    "TRUE":     Word{ "TRUE", W_TRUE,    false, 0 },
-    "+":        Word{ "+", W_PLUS,    false, 2 },
-    "-":        Word{ "-", W_MINUS,    false, 2 },
-    "~":        Word{ "-", W_REVERSE_MINUS,    false, 2 },
-    "*":        Word{ "*", W_TIMES,    false, 2 },
-    "/":        Word{ "/", W_DIVIDE,    false, 2 },
-    "\\":       Word{ "\\", W_REVERSE_DIVIDE,    false, 2 },
-    "MOD":      Word{ "MOD", W_MOD,    false, 2 },
-    "DMOD":     Word{ "DMOD", W_DMOD,    false, 2 },
-
-    "=":        Word{ "=", W_EQUALS,    false, 2 },
-    ">":        Word{ ">", W_GREATER,    false, 2 },
-    "<":        Word{ "<", W_LESS,    false, 2 },
-    "NOT":      Word{ "NOT", W_NOT,    false, 1 },
-    "AND":      Word{ "AND", W_AND,    false, 2 },
-    "OR":       Word{ "OR", W_OR,    false, 2 },
-    "MAX":      Word{ "MAX", W_MAX,    false, 2 },
-    "MIN":      Word{ "MIN", W_MIN,    false, 2 },
-
-
-    "DUP":      Word{ "DUP", W_DUP,    false, 1 },
-    "|":        Word{ "DUP", W_DUP,    false, 1 },
-    "DDUP":     Word{ "DDUP", W_DDUP,    false, 2 },
-    "OVER":     Word{ "OVER", W_OVER,    false, 2 },
-    "DROP":     Word{ "DROP", W_DROP,    false, 1 },
-    "NIP":      Word{ "NIP", W_NIP,    false, 2 },
-    "TUCK":     Word{ "TUCK", W_TUCK,    false, 1 },
-    "SWAP":     Word{ "SWAP", W_SWAP,    false, 2 },
-    "ROT":      Word{ "ROT", W_ROT,    false, 3 },
-    "HIDE":     Word{ "HIDE", W_HIDE,    false, 3 },
-    "FIDDLE":   Word{ "FIDDLE", W_FIDDLE, false, 3 },
-
-    "HZ":       Word{ "HZ", W_HZ,    true, 1 },
-    "BPM":      Word{ "BPM", W_BPM,    true, 1 },
-    "S":        Word{ "S", W_S,    true, 1 },
-
-    "FLAT":     Word{ "FLAT", W_FLAT,    false, 1 },
-    "♭":        Word{ "FLAT", W_FLAT,    false, 1 },
-    "SHARP":    Word{ "SHARP", W_SHARP,    false, 1 },
-    "#":        Word{ "SHARP", W_SHARP,    false, 1 },
-    "♯":        Word{ "SHARP", W_SHARP,    false, 1 },
-    "HIGH":     Word{ "HIGH", W_HIGH,    false, 1 },
-    "'":        Word{ "HIGH", W_HIGH,    false, 1 },
-    "↑":        Word{ "HIGH", W_HIGH,    false, 1 },
-    "LOW":      Word{ "LOW", W_LOW,    false, 1 },
-    "_":        Word{ "LOW", W_LOW,    false, 1 },
-    "↓":        Word{ "LOW", W_LOW,    false, 1 },
-
-    "ON":       Word{ "ON", W_ON,    false, 3 },
-
-    "T":        Word{ "T", W_T,    true, 0 },
-    "SIN":      Word{ "SIN", W_SIN,    true, 1 },
-    "SAW":      Word{ "SAW", W_SAW,    true, 1 },
-    "TR":       Word{ "TR", W_TR,    true, 1 },
-    "PULSE":    Word{ "PULSE", W_PULSE,    true, 2 },
-    "SQ":       Word{ "SQ", W_SQ,    true, 1 },
-    "NOISE":       Word{ "NOISE", W_NOISE,  false, 0 },
-
-    "PREWARP":  Word{ "PREWARP", W_PREWARP,  false, 1 },
+    "NOOP":     Word{ "NOOP", W_NOOP, false, 0, 0 },
+    "LITERAL":  Word{ "NOOP", W_NOOP, false, 0, 0 }, // merely to allow [ ] LITERAL to work like in forth
+    ".":        Word{ ".", W_OUTPUT, false, 1, 0 },
+    "&":        Word{ "&", W_DUP_OUTPUT, false, 1, 0 },
+    "CLIP":     Word{ "CLIP", W_CLIP,   false, 1, 0 },
+    "CH":       Word{ "CH", W_CHANNEL, false, 2, 0 },
+    "LEFT":     Word{ "LEFT", W_LEFT, false, 1, 0 },
+    "RIGHT":    Word{ "RIGHT", W_RIGHT, false, 1, 0 },
+    "PAN":      Word{ "PAN", W_PAN, false, 2, 0 },
+
+    "(":        Word{ "(", W_BEGIN_COMMENT,  false, 0, 0 },
+    ")":        Word{ ")", W_END_COMMENT,  false, 0, 0 },
+    ":":        Word{ ":", W_BEGIN_DEF,  false, 0, 0 },
+    ";":        Word{ ";", W_END_DEF,  false, 0, 0 },
+    "IF":       Word{ "IF", W_IF,  false, 1, 0 },
+    "THEN":     Word{ "THEN", W_THEN,  false, 0, 0 },
+    "ELSE":     Word{ "ELSE", W_ELSE,  false, 0, 0 },
+    "DO":       Word{ "DO", W_DO,  false, 2, 0 },
+    "LOOP":     Word{ "LOOP", W_LOOP,  false, 0, 0 },
+    "I":        Word{ "I", W_I,  false, 0, 0 },
+    "J":        Word{ "J", W_J,  false, 0, 0 },
+    "CHOOSE":   Word{ "CHOOSE", W_CHOOSE,  false, 0, 0 },
+    "FROM":     Word{ "FROM", W_FROM,  false, 1, 0 },
+    ",":        Word{ ",", W_CHOOSE_SEP, false, 0, 0 },
+    "[":        Word{ "[", W_BEGIN_LITERAL,  false, 0, 0 },
+    "]":        Word{ "]", W_END_LITERAL,  false, 0, 0 },
+
+    "KEEP":     Word{ "KEEP", W_KEEP,  false, 1, 0 },
+    "CONSTANT": Word{ "CONSTANT", W_CONSTANT,  false, 0, 0 },
+    "CONTROL":  Word{ "CONSTANT", W_CONSTANT,  false, 0, 0 }, // CONSTANTs are confusingly not constant, provide a synonym
+    "VARIABLE": Word{ "VARIABLE", W_VARIABLE,  false, 1, 0 },
+    "@":        Word{ "PEEK", W_PEEK,  true, 1, 0 },
+    "!":        Word{ "POKE", W_POKE,  true, 2, 0 },
+    "OLD":      Word{ "OLD", W_OLD, true, 2, 0 },
+    "DELTA":    Word{ "DELTA", W_DELTA, true, 1, 0 },
+
+    "FALSE":    Word{ "FALSE", W_FALSE,    false, 0, 0 },
+    "TRUE":     Word{ "TRUE", W_TRUE,    false, 0, 0 },
+    "+":        Word{ "+", W_PLUS,    false, 2, 0 },
+    "-":        Word{ "-", W_MINUS,    false, 2, 0 },
+    "~":        Word{ "-", W_REVERSE_MINUS,    false, 2, 0 },
+    "*":        Word{ "*", W_TIMES,    false, 2, 0 },
+    "/":        Word{ "/", W_DIVIDE,    false, 2, 0 },
+    "\\":       Word{ "\\", W_REVERSE_DIVIDE,    false, 2, 0 },
+    "MOD":      Word{ "MOD", W_MOD,    false, 2, 0 },
+    "DMOD":     Word{ "DMOD", W_DMOD,    false, 2, 0 },
+
+    "=":        Word{ "=", W_EQUALS,    false, 2, 0 },
+    ">":        Word{ ">", W_GREATER,    false, 2, 0 },
+    "<":        Word{ "<", W_LESS,    false, 2, 0 },
+    "NOT":      Word{ "NOT", W_NOT,    false, 1, 0 },
+    "AND":      Word{ "AND", W_AND,    false, 2, 0 },
+    "OR":       Word{ "OR", W_OR,    false, 2, 0 },
+    "MAX":      Word{ "MAX", W_MAX,    false, 2, 0 },
+    "MIN":      Word{ "MIN", W_MIN,    false, 2, 0 },
+
+
+    "DUP":      Word{ "DUP", W_DUP,    false, 1, 0 },
+    "|":        Word{ "DUP", W_DUP,    false, 1, 0 },
+    "DDUP":     Word{ "DDUP", W_DDUP,    false, 2, 0 },
+    "OVER":     Word{ "OVER", W_OVER,    false, 2, 0 },
+    "DROP":     Word{ "DROP", W_DROP,    false, 1, 0 },
+    "NIP":      Word{ "NIP", W_NIP,    false, 2, 0 },
+    "TUCK":     Word{ "TUCK", W_TUCK,    false, 1, 0 },
+    "SWAP":     Word{ "SWAP", W_SWAP,    false, 2, 0 },
+    "ROT":      Word{ "ROT", W_ROT,    false, 3, 0 },
+    "HIDE":     Word{ "HIDE", W_HIDE,    false, 3, 0 },
+    "FIDDLE":   Word{ "FIDDLE", W_FIDDLE, false, 3, 0 },
+
+    "HZ":       Word{ "HZ", W_HZ,    true, 1, 0 },
+    "BPM":      Word{ "BPM", W_BPM,    true, 1, 0 },
+    "S":        Word{ "S", W_S,    true, 1, 0 },
+    "BEAT":     Word{ "BEAT", W_BEAT,    true, 0, 0 },
+    "TEMPO":    Word{ "TEMPO", W_TEMPO,    false, 0, 0 },
+
+    "FLAT":     Word{ "FLAT", W_FLAT,    false, 1, 0 },
+    "♭":        Word{ "FLAT", W_FLAT,    false, 1, 0 },
+    "SHARP":    Word{ "SHARP", W_SHARP,    false, 1, 0 },
+    "#":        Word{ "SHARP", W_SHARP,    false, 1, 0 },
+    "♯":        Word{ "SHARP", W_SHARP,    false, 1, 0 },
+    "HIGH":     Word{ "HIGH", W_HIGH,    false, 1, 0 },
+    "'":        Word{ "HIGH", W_HIGH,    false, 1, 0 },
+    "↑":        Word{ "HIGH", W_HIGH,    false, 1, 0 },
+    "LOW":      Word{ "LOW", W_LOW,    false, 1, 0 },
+    "_":        Word{ "LOW", W_LOW,    false, 1, 0 },
+    "↓":        Word{ "LOW", W_LOW,    false, 1, 0 },
+
+    "ON":       Word{ "ON", W_ON,    false, 3, 0 },
+    "ADSR":     Word{ "ADSR", W_ADSR,    true, 6, ENVELOPE_STATE },
+    "AR":       Word{ "AR", W_AR,    true, 4, ENVELOPE_STATE },
+    "GLIDE":    Word{ "GLIDE", W_GLIDE,    true, 2, GLIDE_STATE },
+    "LAG":      Word{ "LAG", W_LAG,    true, 2, LAG_STATE },
+
+    "NOTE":     Word{ "NOTE", W_NOTE,    true, 2, 0 },
+    "VELOCITY": Word{ "VELOCITY", W_VELOCITY,    true, 2, 0 },
+    "GATE":     Word{ "GATE", W_GATE,    true, 2, 0 },
+    "AGE":      Word{ "AGE", W_AGE,    true, 2, 0 },
+    "LIVE":     Word{ "LIVE", W_LIVE,    false, 0, 0 },
+    "VOICES":   Word{ "VOICES", W_VOICES,    true, 1, 0 },
+
+    "T":        Word{ "T", W_T,    true, 0, 0 },
+    "PHASE":    Word{ "PHASE", W_PHASE,    true, 1, PHASE_STATE },
+    "SIN":      Word{ "SIN", W_SIN,    true, 1, 0 },
+    "SAW":      Word{ "SAW", W_SAW,    true, 1, 0 },
+    "TR":       Word{ "TR", W_TR,    true, 1, 0 },
+    "PULSE":    Word{ "PULSE", W_PULSE,    true, 2, 0 },
+    "SQ":       Word{ "SQ", W_SQ,    true, 1, 0 },
+    "NOISE":    Word{ "NOISE", W_NOISE,  true, 0, 0 },
+    "RAMP":     Word{ "RAMP", W_RAMP,    true, 1, 0 },
+    "BLSAW":    Word{ "BLSAW", W_BLSAW,    true, 2, 0 },
+    "BLSQ":     Word{ "BLSQ", W_BLSQ,    true, 2, 0 },
+    "BLPULSE":  Word{ "BLPULSE", W_BLPULSE,    true, 3, 0 },
+    "BLTR":     Word{ "BLTR", W_BLTR,    true, 2, 0 },
+    "PINK":     Word{ "PINK", W_PINK,    true, 0, 0 },
+    "BROWN":    Word{ "BROWN", W_BROWN,    true, 0, BROWN_STATE },
+    "SH":       Word{ "SH", W_SH,    true, 1, 0 },
+    "SEED":     Word{ "SEED", W_SEED,    false, 1, 0 },
+
+    "PLAY":     Word{ "PLAY", W_PLAY,    true, 3, 0 },
+    "LOOPED":   Word{ "LOOPED", W_LOOPED,    true, 3, 0 },
+    "WAVE":     Word{ "WAVE", W_WAVE,    true, 2, 0 },
+
+    "OP":       Word{ "OP", W_OP,    true, 2, OPERATOR_STATE },
+    "OPFB":     Word{ "OPFB", W_OPFB,    true, 3, OPERATOR_STATE },
+
+    "PREWARP":  Word{ "PREWARP", W_PREWARP,  false, 1, 0 },
+
+    "LPF":      Word{ "LPF", W_LPF,    true, 3, FILTER_STATE },
+    "HPF":      Word{ "HPF", W_HPF,    true, 3, FILTER_STATE },
+    "BPF":      Word{ "BPF", W_BPF,    true, 3, FILTER_STATE },
+    "NOTCH":    Word{ "NOTCH", W_NOTCH,    true, 3, FILTER_STATE },
+    "PEAK":     Word{ "PEAK", W_PEAK,    true, 4, FILTER_STATE },
+    "LOSHELF":  Word{ "LOSHELF", W_LOSHELF,    true, 4, FILTER_STATE },
+    "HISHELF":  Word{ "HISHELF", W_HISHELF,    true, 4, FILTER_STATE },
+
+    "DELAY":    Word{ "DELAY", W_DELAY,    true, 2, DELAY_STATE },
+    "ECHO":     Word{ "ECHO", W_ECHO,    true, 3, DELAY_STATE },
+    "COMB":     Word{ "COMB", W_COMB,    true, 3, DELAY_STATE },
+    "ALLPASS":  Word{ "ALLPASS", W_ALLPASS,    true, 3, DELAY_STATE },
+}
+
+/* Every word by opcode, so running an instruction doesn't need a map lookup */
+var OPCODES [256]Word
+
+func init() {
+    for _, w := range WORDS {
+        OPCODES[w.opcode] = w
+    }
+    OPCODES[W_NUMBER] = Word{ "n", W_NUMBER, false, 0, 0 } // this opcode is created, not supplied
+    OPCODES[W_END_VOICES] = Word{ "VOICES", W_END_VOICES, true, 1, 0 } // so is this one, after the patch
 }